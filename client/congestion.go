@@ -0,0 +1,140 @@
+package main
+
+import (
+	"time"
+)
+
+// Parámetros del control de congestión del envío por UDP:
+const (
+	udpInitialWindow = 10                     // Fragmentos que se pueden enviar antes de la primera confirmación
+	udpMinWindow     = 2                      // Ventana mínima después de una pérdida
+	udpMaxWindow     = 2048                   // Ventana máxima: los fragmentos que cubre el mapa de bits de una confirmación
+	udpMinRTO        = 200 * time.Millisecond // Tiempo mínimo de espera antes de dar un fragmento por perdido
+	udpMaxRTO        = time.Second            // Tiempo máximo de espera, incluso tras varias esperas sin respuesta
+	udpPacingSlack   = 2 * time.Millisecond   // Retraso del ritmo de envío que se recupera enviando de golpe
+)
+
+// Reducción de la ventana ante una pérdida. Si el RTT no supera el mínimo en más de udpQueueDelayFactor,
+// no hay cola en la red y la pérdida se atribuye al enlace (por ejemplo, una red inalámbrica) en lugar de
+// a la congestión, por lo que la ventana se reduce menos:
+const (
+	udpQueueDelayFactor = 1.25
+	udpCongestionLoss   = 0.5 // Ventana que se conserva tras una pérdida por congestión
+	udpRandomLoss       = 0.8 // Ventana que se conserva tras una pérdida sin cola en la red
+)
+
+// Ganancias del ritmo de envío sobre la tasa que permite la ventana (ventana / RTT). Durante el arranque
+// lento se envía más rápido para que la ventana pueda duplicarse en cada RTT:
+const (
+	udpSlowStartPacingGain = 2.0
+	udpPacingGain          = 1.25
+)
+
+// congestionControl adapta la cantidad de fragmentos en vuelo a la capacidad de la red y del servidor
+// con un esquema AIMD: la ventana crece en un fragmento por confirmación durante el arranque lento y en
+// un fragmento por RTT después, y se reduce cuando se pierde un fragmento: a la mitad si el RTT muestra
+// que hay cola en la red, o menos si no la hay. Los fragmentos se envían a un ritmo constante de
+// ventana / RTT en lugar de en ráfagas, que desbordan el búfer del servidor aunque la ventana sea
+// pequeña.
+type congestionControl struct {
+	cwnd      float64       // Ventana de congestión, en fragmentos
+	ssthresh  float64       // Umbral donde termina el arranque lento
+	srtt      time.Duration // RTT suavizado; 0 hasta la primera medición
+	latestRTT time.Duration // Última medición del RTT
+	minRTT    time.Duration // RTT mínimo medido, sin cola en la red
+	rttvar    time.Duration // Variación del RTT
+	rto       time.Duration // Tiempo de espera antes de dar un fragmento por perdido
+	recovery  uint64        // Último envío antes de la reducción más reciente de la ventana
+	nextSend  time.Time     // Momento a partir del cual el ritmo permite enviar otro fragmento
+}
+
+// newCongestionControl crea el control de congestión de una transferencia nueva.
+func newCongestionControl() *congestionControl {
+	return &congestionControl{
+		cwnd:     udpInitialWindow,
+		ssthresh: udpMaxWindow,
+		rto:      udpRetryTimeout,
+	}
+}
+
+// window devuelve la cantidad de fragmentos que pueden estar en vuelo.
+func (c *congestionControl) window() int {
+	return int(c.cwnd)
+}
+
+// onRTT actualiza el RTT suavizado y el tiempo de espera con una medición, como TCP (RFC 6298).
+func (c *congestionControl) onRTT(rtt time.Duration) {
+	c.latestRTT = rtt
+	if c.minRTT == 0 || rtt < c.minRTT {
+		c.minRTT = rtt
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		c.rttvar = (3*c.rttvar + (c.srtt - rtt).Abs()) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, udpMinRTO), udpMaxRTO)
+}
+
+// onAck hace crecer la ventana por cada fragmento confirmado.
+func (c *congestionControl) onAck(acked int) {
+	for i := 0; i < acked; i++ {
+		if c.cwnd < c.ssthresh {
+			c.cwnd++
+		} else {
+			c.cwnd += 1 / c.cwnd
+		}
+	}
+	c.cwnd = min(c.cwnd, udpMaxWindow)
+}
+
+// onLoss reduce la ventana cuando se pierde el fragmento del envío número sent, de los sends envíos
+// hechos hasta ahora. Las pérdidas de fragmentos enviados antes de la última reducción pertenecen a la
+// misma congestión y no la reducen otra vez.
+func (c *congestionControl) onLoss(sent, sends uint64) {
+	if sent <= c.recovery {
+		return
+	}
+	c.recovery = sends
+	factor := udpCongestionLoss
+	if c.srtt != 0 && float64(c.latestRTT) <= float64(c.minRTT)*udpQueueDelayFactor {
+		factor = udpRandomLoss
+	}
+	c.ssthresh = max(c.cwnd*factor, udpMinWindow)
+	c.cwnd = c.ssthresh
+}
+
+// onTimeout reinicia el arranque lento cuando el servidor no responde durante todo el tiempo de espera,
+// y duplica ese tiempo para la siguiente espera.
+func (c *congestionControl) onTimeout(sends uint64) {
+	c.recovery = sends
+	c.ssthresh = max(c.cwnd/2, udpMinWindow)
+	c.cwnd = udpMinWindow
+	c.rto = min(2*c.rto, udpMaxRTO)
+}
+
+// canSend indica si el ritmo de envío permite enviar un fragmento en el momento now.
+func (c *congestionControl) canSend(now time.Time) bool {
+	return !now.Before(c.nextSend)
+}
+
+// onSend registra el envío de un fragmento en el momento now y calcula cuándo se puede enviar el
+// siguiente. Antes de la primera medición del RTT no se limita el ritmo.
+func (c *congestionControl) onSend(now time.Time) {
+	if c.srtt == 0 {
+		return
+	}
+	gain := udpPacingGain
+	if c.cwnd < c.ssthresh {
+		gain = udpSlowStartPacingGain
+	}
+	interval := time.Duration(float64(c.srtt) / (c.cwnd * gain))
+	// Si el envío se retrasó (por ejemplo, por la resolución del temporizador), se permite recuperar
+	// hasta udpPacingSlack enviando de golpe:
+	if earliest := now.Add(-udpPacingSlack); c.nextSend.Before(earliest) {
+		c.nextSend = earliest
+	}
+	c.nextSend = c.nextSend.Add(interval)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Tipos de paquete del modo UDP cifrado:
+const (
+	PacketHello      = 5 // Llave pública efímera del cliente (cliente → servidor)
+	PacketHelloReply = 6 // Llave pública efímera del servidor (servidor → cliente)
+	PacketSealed     = 7 // Paquete cifrado y autenticado con la llave de la sesión
+)
+
+const (
+	publicKeyLen    = 32 // Longitud de una llave pública X25519
+	sealedHeaderLen = 13 // Tipo de paquete (1) + ID de transferencia (4) + contador (8)
+)
+
+// Dirección del paquete, usada en el nonce para que cada sentido tenga su propia secuencia:
+const (
+	directionClient = 0 // Paquetes enviados por el cliente
+	directionServer = 1 // Paquetes enviados por el servidor
+)
+
+// udpCipher cifra y descifra los paquetes de una sesión UDP con ChaCha20-Poly1305. Cada sentido usa
+// una llave distinta derivada del intercambio X25519 y de la llave precompartida, si existe.
+type udpCipher struct {
+	transferID uint32
+	sealKey    cipher.AEAD // Llave para cifrar los paquetes enviados
+	openKey    cipher.AEAD // Llave para descifrar los paquetes recibidos
+	counter    uint64      // Contador de paquetes enviados, forma parte del nonce
+}
+
+// newClientKey genera la llave efímera X25519 del cliente para el intercambio de llaves.
+func newClientKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// newClientCipher completa el intercambio de llaves con la llave pública del servidor y devuelve el
+// cifrador de la sesión.
+func newClientCipher(transferID uint32, private *ecdh.PrivateKey, serverPub []byte, psk string) (*udpCipher, error) {
+	peer, err := ecdh.X25519().NewPublicKey(serverPub)
+	if err != nil {
+		return nil, fmt.Errorf("llave pública del servidor no válida: %v", err)
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := deriveUDPKeys(shared, psk, transferID, private.PublicKey().Bytes(), serverPub)
+	if err != nil {
+		return nil, err
+	}
+	return &udpCipher{transferID: transferID, sealKey: keys[directionClient], openKey: keys[directionServer]}, nil
+}
+
+// deriveUDPKeys deriva con HKDF-SHA256 una llave por cada sentido de la sesión. La llave precompartida
+// se usa como sal, de modo que solo quien la conoce puede derivar las mismas llaves. Sin llave
+// precompartida el intercambio no está autenticado: protege de quien solo escucha el tráfico, pero no
+// de un atacante en la ruta que se haga pasar por el servidor y lea la credencial del cliente.
+func deriveUDPKeys(shared []byte, psk string, transferID uint32, clientPub, serverPub []byte) ([2]cipher.AEAD, error) {
+	var keys [2]cipher.AEAD
+	info := make([]byte, 0, 4+2*publicKeyLen)
+	info = binary.BigEndian.AppendUint32(info, transferID)
+	info = append(info, clientPub...)
+	info = append(info, serverPub...)
+
+	kdf := hkdf.New(sha256.New, shared, []byte(psk), info)
+	for i := range keys {
+		key := make([]byte, chacha20poly1305.KeySize)
+		_, err := io.ReadFull(kdf, key)
+		if err != nil {
+			return keys, err
+		}
+		keys[i], err = chacha20poly1305.New(key)
+		if err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// seal cifra un paquete completo y lo envuelve en un paquete PacketSealed. El encabezado del paquete
+// sellado se autentica como dato adicional.
+func (c *udpCipher) seal(packet []byte, direction uint32) []byte {
+	c.counter++
+	sealed := make([]byte, sealedHeaderLen, sealedHeaderLen+len(packet)+chacha20poly1305.Overhead)
+	sealed[0] = PacketSealed
+	binary.BigEndian.PutUint32(sealed[1:5], c.transferID)
+	binary.BigEndian.PutUint64(sealed[5:13], c.counter)
+	return c.sealKey.Seal(sealed, udpNonce(direction, c.counter), packet, sealed[:sealedHeaderLen])
+}
+
+// open verifica y descifra un paquete PacketSealed. Devuelve un error si el paquete fue alterado o
+// no fue cifrado con la llave de la sesión.
+func (c *udpCipher) open(sealed []byte, direction uint32) ([]byte, error) {
+	if len(sealed) < sealedHeaderLen+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("paquete cifrado incompleto")
+	}
+	counter := binary.BigEndian.Uint64(sealed[5:13])
+	packet, err := c.openKey.Open(nil, udpNonce(direction, counter), sealed[sealedHeaderLen:], sealed[:sealedHeaderLen])
+	if err != nil {
+		return nil, fmt.Errorf("paquete cifrado no válido: %v", err)
+	}
+	if len(packet) < packetHeaderLen || binary.BigEndian.Uint32(packet[1:packetHeaderLen]) != c.transferID {
+		return nil, fmt.Errorf("paquete cifrado no pertenece a la transferencia")
+	}
+	return packet, nil
+}
+
+// udpNonce construye el nonce de 12 bytes a partir de la dirección y el contador del paquete.
+func udpNonce(direction uint32, counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint32(nonce[0:4], direction)
+	binary.BigEndian.PutUint64(nonce[4:12], counter)
+	return nonce
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
@@ -13,6 +14,7 @@ import (
 func main() {
 	// Se verifica la cantidad de argumentos:
 	var filePath string
+	var uploads []Upload
 	if len(os.Args) < 2 {
 		fmt.Println("error ruta de archivo no encontrada.")
 		os.Exit(1)
@@ -22,19 +24,104 @@ func main() {
 	ip := flag.String("ip", ConnHost, "IP address")
 	port := flag.String("p", strconv.Itoa(ConnPort), "Port number")
 	protocol := flag.String("t", ConnType, "Protocol type")
+	useTLS := flag.Bool("tls", false, "Use TLS for TCP connections")
+	caFile := flag.String("ca", "", "CA bundle to verify the server certificate (implies -tls)")
+	certFile := flag.String("cert", "", "Client certificate for mutual TLS (implies -tls)")
+	keyFile := flag.String("key", "", "Client certificate private key for mutual TLS")
+	udpEncrypt := flag.Bool("udp-encrypt", false, "Encrypt UDP transfers (without -psk this only protects against passive eavesdroppers)")
+	psk := flag.String("psk", "", "Pre-shared key for encrypted UDP transfers (implies -udp-encrypt)")
+	token := flag.String("token", "", "Access token sent to the server (default $CLIENT_TOKEN)")
+	onConflict := flag.String("on-conflict", "", "What the server does if the file already exists: overwrite, reject, rename or version (default server policy)")
+	workers := flag.Int("j", 1, "Number of files uploaded in parallel, each over its own connection")
+	quiet := flag.Bool("quiet", false, "Only print upload errors, without progress")
+	jsonProgress := flag.Bool("json-progress", false, "Print upload progress and results as JSON lines")
+	rateLimit := flag.String("limit", "", "Maximum transfer rate shared by all connections, e.g. 5MB/s or 512KiB/s (default no limit)")
+	keepPaths := flag.Bool("keep-paths", false, "Preserve the paths of files inside uploaded directories, relative to the directory's parent (TCP only)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [put] <file|dir|glob>... | get [-o path] <category> <name> | ls [-match glob] [-offset n] [-limit n] [-json] [category] | rm <category> <name> | mv <category> <name> <new name> | usage\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
 	// Se hace el parseo de las banderas:
 	flag.Parse()
 
-	// Se obtiene la ruta del archivo:
-	filePath = flag.Arg(0)
-
-	// Se validan la ruta del archivo, la IP y el puerto:
-	if !IsValidFilePath(filePath) {
-		fmt.Println("Ruta del archivo no válida:", filePath)
+	// Se obtiene el comando, si se indicó, y las rutas de los archivos. Sin comando se suben los
+	// archivos; el comando put permite subir un archivo cuyo nombre coincide con el de un comando:
+	command, args := "put", flag.Args()
+	if len(args) > 0 && contains(args[0], Commands) {
+		command, args = args[0], args[1:]
+	}
+	if command != "put" && *protocol != "tcp" {
+		fmt.Println("El comando", command, "solo está disponible por TCP.")
 		os.Exit(1)
 	}
 
+	if command == "put" {
+		if *keepPaths && *protocol != "tcp" {
+			fmt.Println("La opción -keep-paths solo está disponible por TCP.")
+			os.Exit(1)
+		}
+		if *workers < 1 {
+			fmt.Println("Cantidad de trabajadores no válida:", *workers)
+			os.Exit(1)
+		}
+		// Se validan las rutas y se reúnen los archivos de los patrones y directorios:
+		var err error
+		uploads, err = CollectUploads(args, *keepPaths)
+		if err != nil {
+			fmt.Println("Error al buscar los archivos:", err)
+			os.Exit(1)
+		}
+	}
+
+	// El comando get recibe la categoría y el nombre del archivo, y opcionalmente la ruta de destino:
+	var category, fileName string
+	if command == "get" {
+		getFlags := flag.NewFlagSet("get", flag.ExitOnError)
+		output := getFlags.String("o", "", "Destination path (default the file name in the current directory)")
+		getFlags.Parse(args)
+		if getFlags.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		category, fileName = getFlags.Arg(0), getFlags.Arg(1)
+		filePath = *output
+		if filePath == "" {
+			filePath = filepath.Base(fileName)
+		}
+	}
+
+	// El comando ls recibe opcionalmente la categoría y sus propias banderas para filtrar y paginar:
+	lsFlags := flag.NewFlagSet("ls", flag.ExitOnError)
+	match := lsFlags.String("match", "", "Only list files whose name matches this glob pattern")
+	offset := lsFlags.Uint("offset", 0, "Number of files to skip")
+	limit := lsFlags.Uint("limit", 0, "Maximum number of files to list (default server limit)")
+	asJSON := lsFlags.Bool("json", false, "Print the listing as JSON")
+	if command == "ls" {
+		lsFlags.Parse(args)
+		if lsFlags.NArg() > 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		category = lsFlags.Arg(0)
+	}
+
+	// Los comandos rm y mv reciben la categoría, el nombre del archivo y, para mv, el nombre nuevo:
+	var newName string
+	if command == "rm" || command == "mv" {
+		want := map[string]int{"rm": 2, "mv": 3}[command]
+		if len(args) != want {
+			flag.Usage()
+			os.Exit(1)
+		}
+		category, fileName = args[0], args[1]
+		if command == "mv" {
+			newName = args[2]
+		}
+	}
+
+	// Se validan la IP y el puerto:
 	if !IsValidIP(*ip) {
 		fmt.Println("Dirección IP no válida:", *ip)
 		os.Exit(1)
@@ -45,19 +132,92 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *protocol == "tcp" {
-		// Se envía el archivo por el protocolo TCP:
-		err := SendTCPFile(filePath, *ip, *port)
+	collision, ok := CollisionPolicies[*onConflict]
+	if !ok {
+		fmt.Println("Política de colisión no válida:", *onConflict)
+		os.Exit(1)
+	}
+	GlobalOptions.Collision = collision
+
+	// Se configura TLS si se solicitó:
+	if *useTLS || *caFile != "" || *certFile != "" {
+		tlsConfig, err := LoadTLSConfig(*caFile, *certFile, *keyFile)
 		if err != nil {
-			fmt.Println("Error al enviar el archivo:", err)
+			fmt.Println("Error al configurar TLS:", err)
 			os.Exit(1)
 		}
-	} else if *protocol == "udp" {
-		// Se envía el archivo por el protocolo UDP:
-		err := SendUDPFile(filePath, *ip, *port)
+		GlobalOptions.TLSConfig = tlsConfig
+	}
+
+	// El token se puede indicar en una variable de entorno para que no aparezca en la lista de procesos:
+	GlobalOptions.Token = *token
+	if GlobalOptions.Token == "" {
+		GlobalOptions.Token = os.Getenv("CLIENT_TOKEN")
+	}
+	GlobalOptions.UDPEncrypt = *udpEncrypt || *psk != ""
+	GlobalOptions.UDPPSK = *psk
+	GlobalOptions.KeepPaths = *keepPaths
+
+	if *rateLimit != "" {
+		rate, err := ParseRate(*rateLimit)
 		if err != nil {
-			fmt.Println("Error al enviar el archivo:", err)
+			fmt.Println("Límite de tasa no válido:", err)
 			os.Exit(1)
 		}
+		GlobalOptions.RateLimit = NewRateLimiter(rate)
+	}
+
+	// La barra de avance solo se muestra si la salida es una terminal:
+	GlobalOptions.Quiet = *quiet
+	switch {
+	case *jsonProgress:
+		GlobalOptions.Progress = ProgressJSON
+	case !*quiet && IsTerminal(os.Stdout):
+		GlobalOptions.Progress = ProgressBar
+	}
+
+	if command == "get" {
+		// Se descarga el archivo:
+		err := GetFile(*ip, *port, category, fileName, filePath)
+		if err != nil {
+			fmt.Println("Error al descargar el archivo:", err)
+			os.Exit(ExitCode(err))
+		}
+	} else if command == "ls" {
+		// Se listan los archivos guardados:
+		err := ListFiles(*ip, *port, category, *match, uint32(*offset), uint32(*limit), *asJSON)
+		if err != nil {
+			fmt.Println("Error al listar los archivos:", err)
+			os.Exit(ExitCode(err))
+		}
+	} else if command == "rm" {
+		// Se elimina el archivo:
+		err := DeleteFile(*ip, *port, category, fileName)
+		if err != nil {
+			fmt.Println("Error al eliminar el archivo:", err)
+			os.Exit(ExitCode(err))
+		}
+	} else if command == "mv" {
+		// Se cambia el nombre del archivo:
+		err := RenameFile(*ip, *port, category, fileName, newName)
+		if err != nil {
+			fmt.Println("Error al renombrar el archivo:", err)
+			os.Exit(ExitCode(err))
+		}
+	} else if command == "usage" {
+		// Se consulta el uso de almacenamiento:
+		err := RequestUsage(*ip, *port)
+		if err != nil {
+			fmt.Println("Error al consultar el uso de almacenamiento:", err)
+			os.Exit(ExitCode(err))
+		}
+	} else if *protocol == "tcp" {
+		// Se envían los archivos por el protocolo TCP; cada trabajador reutiliza su conexión:
+		results := SendTCPFiles(uploads, *ip, *port, *workers)
+		os.Exit(ReportUploads(results))
+	} else if *protocol == "udp" {
+		// Se envían los archivos por el protocolo UDP, cada uno en su propia sesión:
+		results := SendUDPFiles(uploads, *ip, *port, *workers)
+		os.Exit(ReportUploads(results))
 	}
 }
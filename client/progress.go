@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formas de mostrar el avance de las subidas:
+const (
+	ProgressNone = iota // No se muestra el avance
+	ProgressBar         // Barra de avance en la terminal
+	ProgressJSON        // Eventos en formato JSON, uno por línea, para scripts
+)
+
+// progressInterval es el tiempo entre dos actualizaciones del avance.
+const progressInterval = 200 * time.Millisecond
+
+// progressBarWidth es la cantidad de caracteres de la barra de avance.
+const progressBarWidth = 30
+
+// IsTerminal indica si file es una terminal, para mostrar la barra de avance solo cuando alguien la ve.
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress lleva la cuenta de los bytes enviados en un grupo de subidas y muestra el avance total, la
+// tasa de transferencia y el tiempo restante estimado cada progressInterval. Los trabajadores en
+// paralelo comparten el mismo Progress. Un *Progress nulo no muestra nada.
+type Progress struct {
+	mu         sync.Mutex
+	mode       int       // ProgressBar o ProgressJSON
+	out        io.Writer // Destino del avance
+	total      int64     // Bytes de todos los archivos
+	done       int64     // Bytes enviados o que ya no se enviarán (reanudados o de subidas fallidas)
+	sent       int64     // Bytes enviados en esta ejecución, con los que se calcula la tasa
+	files      int       // Cantidad de archivos
+	filesDone  int       // Cantidad de archivos terminados
+	start      time.Time // Inicio de las subidas
+	drawn      bool      // Indica si la barra está dibujada en la línea actual
+	stop, quit chan struct{}
+}
+
+// NewProgress crea el avance de subidas de files archivos que suman total bytes y empieza a mostrarlo.
+// Devuelve nil si mode es ProgressNone.
+func NewProgress(mode int, files int, total int64) *Progress {
+	if mode == ProgressNone {
+		return nil
+	}
+	p := &Progress{
+		mode:  mode,
+		out:   os.Stdout,
+		total: total,
+		files: files,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		quit:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.quit)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.render()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// File devuelve el avance de un archivo de size bytes dentro del grupo.
+func (p *Progress) File(size int64) *FileProgress {
+	if p == nil {
+		return nil
+	}
+	return &FileProgress{progress: p, size: size}
+}
+
+// Println imprime un mensaje sin mezclarlo con la barra de avance, que se vuelve a dibujar en la
+// siguiente actualización.
+func (p *Progress) Println(a ...any) {
+	if p == nil {
+		fmt.Println(a...)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintln(p.out, a...)
+}
+
+// Event imprime un evento en formato JSON, uno por línea. Solo se usa en el modo ProgressJSON.
+func (p *Progress) Event(event map[string]any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(p.out, string(data))
+}
+
+// Finish deja de actualizar el avance. En JSON se emite el evento final; la barra se borra para dar
+// paso al resumen.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.quit
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mode == ProgressJSON {
+		p.render()
+	}
+	p.clear()
+}
+
+// render muestra el avance actual. Se llama con el mutex tomado.
+func (p *Progress) render() {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.sent) / elapsed
+	}
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.done) * 100 / float64(p.total)
+	}
+	eta := -1.0 // Desconocido mientras no haya una tasa
+	if rate > 0 {
+		eta = float64(p.total-p.done) / rate
+	}
+
+	if p.mode == ProgressJSON {
+		data, err := json.Marshal(map[string]any{
+			"event":      "progress",
+			"sent":       p.done,
+			"total":      p.total,
+			"percent":    percent,
+			"rate":       rate,
+			"eta":        eta,
+			"files":      p.filesDone,
+			"totalFiles": p.files,
+		})
+		if err == nil {
+			fmt.Fprintln(p.out, string(data))
+		}
+		return
+	}
+
+	filled := min(max(int(percent/100*progressBarWidth), 0), progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	line := fmt.Sprintf("[%s] %3.0f%% %s/%s %s/s ETA %s", bar, percent, FormatBytes(p.done), FormatBytes(p.total), FormatBytes(int64(rate)), formatETA(eta))
+	if p.files > 1 {
+		line += fmt.Sprintf(" (%d/%d archivos)", p.filesDone, p.files)
+	}
+	fmt.Fprint(p.out, "\r\033[K"+line)
+	p.drawn = true
+}
+
+// clear borra la barra de la línea actual. Se llama con el mutex tomado.
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// formatETA da formato a un tiempo restante en segundos, o "--:--" si se desconoce.
+func formatETA(seconds float64) string {
+	if seconds < 0 {
+		return "--:--"
+	}
+	s := int(seconds + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
+
+// FileProgress es el avance de un archivo dentro de un Progress. Un *FileProgress nulo no hace nada,
+// de modo que las funciones de envío lo pueden recibir aunque no se muestre el avance.
+type FileProgress struct {
+	progress *Progress
+	size     int64 // Tamaño del archivo
+	counted  int64 // Bytes del archivo ya sumados al avance
+	sent     int64 // Bytes del archivo enviados, sumados a la tasa
+}
+
+// Add suma n bytes enviados del archivo.
+func (f *FileProgress) Add(n int64) {
+	if f == nil {
+		return
+	}
+	f.progress.mu.Lock()
+	defer f.progress.mu.Unlock()
+	f.counted += n
+	f.sent += n
+	f.progress.done += n
+	f.progress.sent += n
+}
+
+// Reset descuenta del avance los bytes del archivo, antes de volver a intentar su envío desde el
+// principio.
+func (f *FileProgress) Reset() {
+	if f == nil {
+		return
+	}
+	f.progress.mu.Lock()
+	defer f.progress.mu.Unlock()
+	f.progress.done -= f.counted
+	f.progress.sent -= f.sent
+	f.counted = 0
+	f.sent = 0
+}
+
+// Skip suma n bytes del archivo que no hace falta enviar porque el servidor ya los tiene.
+func (f *FileProgress) Skip(n int64) {
+	if f == nil {
+		return
+	}
+	f.progress.mu.Lock()
+	defer f.progress.mu.Unlock()
+	f.counted += n
+	f.progress.done += n
+}
+
+// Done marca el archivo como terminado. Si la subida falló, los bytes que faltaban se dan por
+// terminados para que el avance total llegue al 100 %.
+func (f *FileProgress) Done() {
+	if f == nil {
+		return
+	}
+	f.progress.mu.Lock()
+	defer f.progress.mu.Unlock()
+	if f.counted < f.size {
+		f.progress.done += f.size - f.counted
+		f.counted = f.size
+	}
+	f.progress.filesDone++
+}
+
+// Println imprime un mensaje sobre el envío del archivo sin mezclarlo con el avance: la barra se borra
+// antes de imprimirlo y, con el avance en JSON, se imprime en la salida de errores para no mezclarlo
+// con los eventos.
+func (f *FileProgress) Println(a ...any) {
+	switch {
+	case f == nil:
+		fmt.Println(a...)
+	case f.progress.mode == ProgressJSON:
+		fmt.Fprintln(os.Stderr, a...)
+	default:
+		f.progress.Println(a...)
+	}
+}
+
+// Writer devuelve un io.Writer que suma al avance los bytes que se escriben en w.
+func (f *FileProgress) Writer(w io.Writer) io.Writer {
+	if f == nil {
+		return w
+	}
+	return progressWriter{w, f}
+}
+
+// progressWriter suma al avance de un archivo los bytes que escribe.
+type progressWriter struct {
+	w io.Writer
+	f *FileProgress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.f.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateBurst es el tiempo de transferencia que un limitador puede acumular mientras no se usa; después de
+// una pausa solo se envían de golpe los bytes de ese tiempo.
+const rateBurst = 100 * time.Millisecond
+
+// rateUnits asocia cada unidad que acepta ParseRate, en minúsculas, con su cantidad de bytes.
+var rateUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// ParseRate convierte una tasa como "5MB/s", "512KiB/s" o "1000000" en bytes por segundo. Las unidades
+// KB, MB y GB son decimales y KiB, MiB y GiB son binarias; el sufijo "/s" es opcional.
+func ParseRate(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+	unit, ok := rateUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unidad no válida: %s", s)
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil || n*unit < 1 {
+		return 0, fmt.Errorf("tasa no válida: %s", s)
+	}
+	return int64(n * unit), nil
+}
+
+// RateLimiter limita la tasa de transferencia con una cubeta de fichas: las fichas se acumulan a rate
+// bytes por segundo, hasta los bytes de rateBurst, y cada transferencia las consume. Si no alcanzan,
+// la transferencia queda en deuda y espera el tiempo necesario para pagarla, de modo que los
+// trabajadores en paralelo se reparten la tasa. Un *RateLimiter nulo no limita nada.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // Bytes por segundo
+	burst  float64   // Fichas máximas acumuladas
+	tokens float64   // Fichas disponibles; negativo si hay transferencias esperando
+	last   time.Time // Última vez que se sumaron fichas
+}
+
+// NewRateLimiter crea un limitador de rate bytes por segundo. Devuelve nil si rate no es positivo.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) * rateBurst.Seconds()
+	return &RateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait consume n fichas y espera hasta que la tasa permita transferir n bytes.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Reader devuelve un io.Reader que lee de r respetando el límite.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return limitedReader{r, l}
+}
+
+// Writer devuelve un io.Writer que escribe en w respetando el límite.
+func (l *RateLimiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return limitedWriter{w, l}
+}
+
+// limitedReader espera después de cada lectura el tiempo que corresponde a los bytes leídos.
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (lr limitedReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	lr.l.Wait(n)
+	return n, err
+}
+
+// limitedWriter espera antes de cada escritura el tiempo que corresponde a los bytes que escribe.
+type limitedWriter struct {
+	w io.Writer
+	l *RateLimiter
+}
+
+func (lw limitedWriter) Write(b []byte) (int, error) {
+	lw.l.Wait(len(b))
+	return lw.w.Write(b)
+}
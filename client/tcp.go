@@ -2,120 +2,514 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
 )
 
-// sendFileTCP envía un archivo a través de una conexión TCP a una dirección IP y puerto especificados.
-// Devuelve un error si ocurre algún problema durante el proceso.
-func SendTCPFile(filePath string, ipConn string, portConn string) error {
-	// Se abre el archivo:
-	file, err := os.Open(filePath)
+// SendTCPFiles envía los archivos indicados a una dirección IP y puerto especificados con workers
+// trabajadores en paralelo, y devuelve el resultado de cada uno. Cada trabajador envía sus archivos uno
+// tras otro por su propia conexión TCP.
+func SendTCPFiles(uploads []Upload, ipConn string, portConn string, workers int) []UploadResult {
+	return RunUploads(uploads, workers, func() uploader {
+		return &tcpUploader{address: ipConn + ":" + portConn}
+	})
+}
+
+// tcpUploader envía archivos por una conexión TCP que se reutiliza entre subidas. Si una subida falla,
+// la conexión puede haber quedado a mitad de un mensaje, así que se abre otra para el siguiente archivo.
+type tcpUploader struct {
+	address string
+	conn    net.Conn // Conexión abierta, nil si no hay ninguna
+	reused  bool     // Indica si la conexión abierta ya se usó para otra subida
+}
+
+// Send envía un archivo y devuelve la ruta con la que lo guardó el servidor.
+func (u *tcpUploader) Send(upload Upload, progress *FileProgress) (string, error) {
+	path, err := u.send(upload, progress)
+	if err != nil && u.conn != nil {
+		u.Close()
+	}
+	return path, err
+}
+
+func (u *tcpUploader) send(upload Upload, progress *FileProgress) (string, error) {
+	// Se abre el archivo y se calcula su hash antes de usar la conexión:
+	file, size, hash, err := openUpload(upload.Path)
 	if err != nil {
-		return fmt.Errorf("error al abrir el archivo: %v", err)
+		return "", err
 	}
 	defer file.Close()
 
-	// Se genera la conexión:
-	conn, err := net.Dial("tcp", ipConn+":"+portConn)
+	// Se genera la conexión si no hay una abierta:
+	if u.conn == nil {
+		u.conn, err = dialTCP(u.address)
+		if err != nil {
+			return "", fmt.Errorf("error al establecer la conexión: %v", err)
+		}
+		u.reused = false
+	}
+
+	path, err := sendTCPFile(u.conn, upload.Name, file, size, hash, progress)
+	var responseErr *ResponseError
+	if err != nil && u.reused && !errors.As(err, &responseErr) {
+		// El servidor pudo cerrar la conexión por inactividad, por ejemplo mientras se calculaba el
+		// hash de un archivo grande; se reintenta una vez con una conexión nueva y la subida continúa
+		// desde lo que el servidor ya recibió:
+		u.conn.Close()
+		progress.Reset()
+		u.conn, err = dialTCP(u.address)
+		if err != nil {
+			return "", fmt.Errorf("error al establecer la conexión: %v", err)
+		}
+		path, err = sendTCPFile(u.conn, upload.Name, file, size, hash, progress)
+	}
+	u.reused = true
+	return path, err
+}
+
+// Close cierra la conexión abierta, si la hay.
+func (u *tcpUploader) Close() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// openUpload abre el archivo que se va a subir y devuelve su tamaño y su hash SHA-256, que identifica
+// la subida ante el servidor.
+func openUpload(filePath string) (*os.File, int64, [32]byte, error) {
+	var hash [32]byte
+	// Se abre el archivo:
+	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error al establecer la conexión: %v", err)
+		return nil, 0, hash, fmt.Errorf("error al abrir el archivo: %v", err)
 	}
-	defer conn.Close()
 
 	// Se obtienen los datos del archivo:
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("error al obtener información del archivo: %v", err)
+		file.Close()
+		return nil, 0, hash, fmt.Errorf("error al obtener información del archivo: %v", err)
 	}
 
-	fileName := fileInfo.Name()
-	fileData, err := io.ReadAll(file)
+	// Se calcula el hash SHA-256 del archivo:
+	hash, err = HashFile(file)
 	if err != nil {
-		return fmt.Errorf("error al leer los datos del archivo: %v", err)
+		file.Close()
+		return nil, 0, hash, fmt.Errorf("error al leer los datos del archivo: %v", err)
+	}
+	return file, fileInfo.Size(), hash, nil
+}
+
+// sendTCPFile envía un archivo por una conexión TCP abierta y devuelve la ruta con la que lo guardó el
+// servidor. Si el servidor ya tiene una parte del archivo de un intento anterior, solo se envía el resto.
+// Devuelve un error si ocurre algún problema durante el proceso.
+func sendTCPFile(conn net.Conn, fileName string, file *os.File, size int64, hash [32]byte, progress *FileProgress) (string, error) {
+	// Se codifica y envía el mensaje al servidor; los datos se copian del disco a la conexión:
+	err := sendTCPMessage(conn, fileName, size, hash, file, progress)
+	if err != nil {
+		return "", fmt.Errorf("error al enviar el mensaje: %w", err)
 	}
 
-	// Se calcula el hash SHA-256 del archivo:
-	hash := sha256.Sum256(fileData)
+	// Lee la respuesta del servidor:
+	response, err := ReadResponse(conn)
+	if err != nil {
+		return "", fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+	}
+
+	err = CheckResponse(response, hash)
+	if err != nil {
+		return "", err
+	}
+	return response.Path, nil
+}
 
-	// Se crea la estructura del mensaje:
-	msg := FileMessage{
-		FileName: fileName,
-		Data:     fileData,
-		Hash:     hash,
+// GetFile descarga el archivo fileName de la categoría indicada y lo guarda en outPath. Los datos se
+// escriben en un archivo temporal junto a outPath, que solo reemplaza a outPath si su hash coincide con
+// el que calculó el servidor.
+func GetFile(ipConn string, portConn string, category string, fileName string, outPath string) error {
+	conn, err := dialTCP(ipConn + ":" + portConn)
+	if err != nil {
+		return fmt.Errorf("error al establecer la conexión: %v", err)
 	}
+	defer conn.Close()
 
-	// Se codifica y envía el mensaje al servidor:
-	err = sendTCPMessage(conn, &msg)
+	err = sendRequestHeader(conn, OpGet, nil)
+	if err != nil {
+		return fmt.Errorf("error al enviar el mensaje: %v", err)
+	}
+	payload := appendString16(nil, category)
+	payload = appendString16(payload, fileName)
+	_, err = conn.Write(payload)
 	if err != nil {
 		return fmt.Errorf("error al enviar el mensaje: %v", err)
 	}
 
-	// Lee la respuesta del servidor:
-	response := make([]byte, 1)
-	_, err = conn.Read(response)
+	// Se lee la respuesta del servidor y, si encontró el archivo, su tamaño:
+	response, err := ReadResponse(conn)
+	if err != nil {
+		return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+	}
+	if response.Status != MsgSuccess {
+		return &ResponseError{Response: response}
+	}
+	sizeBuf := make([]byte, 8)
+	_, err = io.ReadFull(conn, sizeBuf)
 	if err != nil {
 		return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
 	}
+	size := int64(binary.BigEndian.Uint64(sizeBuf))
+
+	// Se reciben los datos en un archivo temporal mientras se calcula su hash:
+	tmpFile, err := createTempFile(filepath.Dir(outPath), "."+filepath.Base(outPath)+".", ".tmp")
+	if err != nil {
+		return fmt.Errorf("error al crear el archivo: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // No hace nada si el archivo ya se renombró
+
+	hasher := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tmpFile, hasher), GlobalOptions.RateLimit.Reader(conn), size)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("error al recibir los datos del archivo: %v", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("error al escribir el archivo: %v", err)
+	}
 
-	if response[0] == 1 {
-		fmt.Println("El archivo se guardó correctamente.")
-	} else {
-		return fmt.Errorf("el archivo no se pudo guardar correctamente")
+	var hash [32]byte
+	copy(hash[:], hasher.Sum(nil))
+	if hash != response.Hash {
+		return fmt.Errorf("el hash del archivo recibido no coincide con el calculado por el servidor")
+	}
+	err = os.Rename(tmpPath, outPath)
+	if err != nil {
+		return fmt.Errorf("error al guardar el archivo: %v", err)
 	}
+	fmt.Println("El archivo se descargó correctamente en", outPath)
 
 	return nil
 }
 
+// createTempFile crea en dir un archivo nuevo con un nombre aleatorio entre prefix y suffix. A diferencia
+// de os.CreateTemp, que lo crea con permisos 0600, los permisos son los de os.Create (0666 menos la
+// umask), ya que el archivo temporal se convierte en el archivo descargado.
+func createTempFile(dir, prefix, suffix string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return file, err
+	}
+	return nil, fmt.Errorf("no se encontró un nombre libre para el archivo temporal en %s", dir)
+}
+
+// FileList es una página del listado de archivos que envía el servidor en formato JSON.
+type FileList struct {
+	Files []struct {
+		Category string `json:"category"` // Nombre de la categoría del archivo
+		Name     string `json:"name"`     // Nombre del archivo
+		Size     int64  `json:"size"`     // Tamaño en bytes
+		ModTime  int64  `json:"modTime"`  // Fecha de la última modificación, en segundos desde la época Unix
+		Hash     string `json:"hash"`     // Hash SHA-256 del contenido, en hexadecimal
+	} `json:"files"`
+	Offset int `json:"offset"` // Posición del primer archivo de la página
+	Total  int `json:"total"`  // Cantidad de archivos que coinciden con el filtro
+}
+
+// ListFiles consulta al servidor los archivos guardados en la categoría indicada (vacía para todas)
+// cuyo nombre coincide con el patrón glob pattern, a partir de offset y de limit en limit archivos (0
+// usa el valor del servidor). Imprime el listado en una tabla o, si asJSON es true, en JSON.
+func ListFiles(ipConn string, portConn string, category string, pattern string, offset uint32, limit uint32, asJSON bool) error {
+	payload := appendString16(nil, category)
+	payload = appendString16(payload, pattern)
+	payload = binary.BigEndian.AppendUint32(payload, offset)
+	payload = binary.BigEndian.AppendUint32(payload, limit)
+	response, err := requestTCP(ipConn+":"+portConn, OpList, payload)
+	if err != nil {
+		return err
+	}
+
+	var list FileList
+	err = json.Unmarshal(response.Body, &list)
+	if err != nil {
+		return fmt.Errorf("error al leer el listado de archivos: %v", err)
+	}
+
+	if asJSON {
+		out, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CATEGORÍA\tNOMBRE\tTAMAÑO\tMODIFICADO\tSHA-256")
+	for _, file := range list.Files {
+		modTime := time.Unix(file.ModTime, 0).Format("2006-01-02 15:04:05")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", file.Category, file.Name, FormatBytes(file.Size), modTime, file.Hash)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Se indica si hay más archivos que los de esta página:
+	if len(list.Files) == 0 {
+		fmt.Printf("Sin archivos (total: %d).\n", list.Total)
+	} else if next := list.Offset + len(list.Files); next < list.Total {
+		fmt.Printf("Archivos %d a %d de %d; usa -offset %d para ver los siguientes.\n", list.Offset+1, next, list.Total, next)
+	}
+	return nil
+}
+
+// DeleteFile elimina el archivo fileName de la categoría indicada en el servidor.
+func DeleteFile(ipConn string, portConn string, category string, fileName string) error {
+	payload := appendString16(nil, category)
+	payload = appendString16(payload, fileName)
+	response, err := requestTCP(ipConn+":"+portConn, OpDelete, payload)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Se eliminó el archivo", response.Path)
+	return nil
+}
+
+// RenameFile cambia el nombre del archivo oldName de la categoría indicada a newName en el servidor.
+func RenameFile(ipConn string, portConn string, category string, oldName string, newName string) error {
+	payload := appendString16(nil, category)
+	payload = appendString16(payload, oldName)
+	payload = appendString16(payload, newName)
+	response, err := requestTCP(ipConn+":"+portConn, OpRename, payload)
+	if err != nil {
+		return err
+	}
+	fmt.Println("El archivo ahora se llama", response.Path)
+	return nil
+}
+
+// UsageReport es el reporte de uso de almacenamiento que envía el servidor en formato JSON.
+type UsageReport struct {
+	Categories []UsageEntry `json:"categories"`
+	Client     *UsageEntry  `json:"client"`
+}
+
+// UsageEntry es el uso de almacenamiento de una categoría o de un cliente.
+type UsageEntry struct {
+	Name  string `json:"name"`  // Nombre de la categoría o del cliente
+	Used  int64  `json:"used"`  // Bytes guardados
+	Quota int64  `json:"quota"` // Cuota en bytes; 0 indica que no hay límite
+}
+
+// RequestUsage consulta al servidor el uso de almacenamiento de cada categoría y del cliente, y lo
+// imprime en una tabla.
+func RequestUsage(ipConn string, portConn string) error {
+	response, err := requestTCP(ipConn+":"+portConn, OpUsage, nil)
+	if err != nil {
+		return err
+	}
+
+	var report UsageReport
+	err = json.Unmarshal(response.Body, &report)
+	if err != nil {
+		return fmt.Errorf("error al leer el reporte de uso: %v", err)
+	}
+
+	entries := report.Categories
+	if report.Client != nil {
+		entries = append(entries, UsageEntry{}, *report.Client)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CATEGORÍA\tEN USO\tCUOTA")
+	for i, entry := range entries {
+		if i == len(report.Categories) {
+			// Separa el uso del cliente del de las categorías:
+			fmt.Fprintln(w, "\nCLIENTE\tEN USO\tCUOTA")
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Name, FormatBytes(entry.Used), formatQuota(entry.Quota))
+	}
+	return w.Flush()
+}
+
+// formatQuota da formato a una cuota en bytes, donde 0 indica que no hay límite.
+func formatQuota(quota int64) string {
+	if quota == 0 {
+		return "sin límite"
+	}
+	return FormatBytes(quota)
+}
+
+// requestTCP abre una conexión con el servidor, envía la operación op seguida de payload y devuelve la
+// respuesta del servidor, o un *ResponseError si la operación no fue exitosa.
+func requestTCP(address string, op byte, payload []byte) (Response, error) {
+	conn, err := dialTCP(address)
+	if err != nil {
+		return Response{}, fmt.Errorf("error al establecer la conexión: %v", err)
+	}
+	defer conn.Close()
+
+	err = sendRequestHeader(conn, op, nil)
+	if err != nil {
+		return Response{}, fmt.Errorf("error al enviar el mensaje: %v", err)
+	}
+	_, err = conn.Write(payload)
+	if err != nil {
+		return Response{}, fmt.Errorf("error al enviar el mensaje: %v", err)
+	}
+
+	response, err := ReadResponse(conn)
+	if err != nil {
+		return Response{}, fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+	}
+	if response.Status != MsgSuccess {
+		return response, &ResponseError{Response: response}
+	}
+	return response, nil
+}
+
+// dialTCP abre una conexión TCP con el servidor, cifrada con TLS si así se configuró.
+func dialTCP(address string) (net.Conn, error) {
+	if GlobalOptions.TLSConfig != nil {
+		conn, err := tls.Dial("tcp", address, GlobalOptions.TLSConfig)
+		if err != nil {
+			return nil, err // Evita devolver un *tls.Conn nulo dentro de una interfaz no nula
+		}
+		return conn, nil
+	}
+	return net.Dial("tcp", address)
+}
+
+// sendRequestHeader envía el encabezado común de los mensajes TCP: la versión del protocolo, la
+// operación solicitada y la credencial del cliente. Los errores se imprimen a través de progress.
+func sendRequestHeader(conn net.Conn, op byte, progress *FileProgress) error {
+	_, err := conn.Write([]byte{ProtocolVersion, op}) // Versión del protocolo, indica el inicio del mensaje
+	if err != nil {
+		progress.Println("[ERROR] al enviar la versión del protocolo: ", err)
+		return err
+	}
+
+	// Se envía la credencial del cliente:
+	tokenLenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(tokenLenBuf, uint16(len(GlobalOptions.Token)))
+	_, err = conn.Write(append(tokenLenBuf, GlobalOptions.Token...))
+	if err != nil {
+		progress.Println("[ERROR] al enviar la credencial: ", err)
+		return err
+	}
+	return nil
+}
+
 // sendTCPMessage envía un mensaje que contiene la información de un archivo a través de una conexión.
-// Devuelve un error si ocurre algún problema durante el proceso.
-func sendTCPMessage(conn net.Conn, msg *FileMessage) error {
+// Primero envía el encabezado con la credencial, la política de colisión, las opciones y el nombre, el
+// tamaño y el hash del archivo; el servidor responde con la cantidad de bytes que ya tiene y se envían
+// los datos restantes desde esa posición. Devuelve un error si ocurre algún problema durante el proceso.
+func sendTCPMessage(conn net.Conn, fileName string, dataLen int64, hash [32]byte, data io.ReadSeeker, progress *FileProgress) error {
 	// Se codifica la estructura del mensaje y se envía a través de la conexión:
-	_, err := conn.Write([]byte{0}) // Indicador de inicio del mensaje
+	err := sendRequestHeader(conn, OpUpload, progress)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar indicador de inicio del mensaje: ", err)
+		return err
+	}
+
+	// Se envían la política de colisión y las opciones de la subida:
+	var flags byte
+	if GlobalOptions.KeepPaths {
+		flags |= UploadKeepPath
+	}
+	_, err = conn.Write([]byte{GlobalOptions.Collision, flags})
+	if err != nil {
+		progress.Println("[ERROR] al enviar la política de colisión: ", err)
 		return err
 	}
 
 	// Se escribe el nombre del archivo en la conexión:
 	fileNameLenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(fileNameLenBuf, uint32(len(msg.FileName)))
+	binary.BigEndian.PutUint32(fileNameLenBuf, uint32(len(fileName)))
 	_, err = conn.Write(fileNameLenBuf)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar la longitud del nombre del archivo: ", err)
+		progress.Println("[ERROR] al enviar la longitud del nombre del archivo: ", err)
 		return err
 	}
 
 	// Se envía el nombre del archivo:
-	_, err = conn.Write([]byte(msg.FileName))
+	_, err = conn.Write([]byte(fileName))
 	if err != nil {
-		fmt.Println("[ERROR] al enviar el nombre del archivo: ", err)
+		progress.Println("[ERROR] al enviar el nombre del archivo: ", err)
 		return err
 	}
 
 	// Se envía el tamaño del buffer de los datos del archivo en la conexión:
-	dataLenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(dataLenBuf, uint32(len(msg.Data)))
+	dataLenBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(dataLenBuf, uint64(dataLen))
 	_, err = conn.Write(dataLenBuf)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar la longitud de los datos del archivo: ", err)
+		progress.Println("[ERROR] al enviar la longitud de los datos del archivo: ", err)
 		return err
 	}
 
-	// Se envían los datos del archivo:
-	_, err = conn.Write(msg.Data)
+	// Se envía el hash del archivo en la conexión:
+	_, err = conn.Write(hash[:])
 	if err != nil {
-		fmt.Println("[ERROR] al enviar los datos del archivo: ", err)
+		progress.Println("[ERROR] al enviar el hash del archivo: ", err)
 		return err
 	}
 
-	// Se envía el hash del archivo en la conexión:
-	_, err = conn.Write(msg.Hash[:])
+	// Se lee la respuesta del servidor, que indica si acepta el archivo y desde qué byte continuar; si
+	// lo rechaza, en su lugar envía la respuesta completa con la causa:
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+	}
+	if reply[0] != MsgSuccess {
+		response, err := readResponseFields(conn, reply[0])
+		if err != nil {
+			return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+		}
+		return &ResponseError{Response: response}
+	}
+	offsetBuf := make([]byte, 8)
+	_, err = io.ReadFull(conn, offsetBuf)
+	if err != nil {
+		return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+	}
+	offset := int64(binary.BigEndian.Uint64(offsetBuf))
+	if offset > dataLen {
+		return fmt.Errorf("el servidor indicó una posición no válida: %d", offset)
+	}
+	if offset > 0 {
+		if !GlobalOptions.Quiet && GlobalOptions.Progress != ProgressJSON {
+			progress.Println(fmt.Sprintf("Reanudando la subida desde el byte %d de %d.", offset, dataLen))
+		}
+		progress.Skip(offset)
+	}
+
+	// Se envían los datos restantes del archivo:
+	_, err = data.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error al leer los datos del archivo: %v", err)
+	}
+	_, err = io.CopyN(progress.Writer(GlobalOptions.RateLimit.Writer(conn)), data, dataLen-offset)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar el hash del archivo: ", err)
+		progress.Println("[ERROR] al enviar los datos del archivo: ", err)
 		return err
 	}
 
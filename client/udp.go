@@ -1,140 +1,490 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"slices"
+	"time"
 )
 
-// SendUDPFile envía un archivo a través de una conexión UDP al servidor especificado.
-func SendUDPFile(filePath string, ipConn string, portConn string) error {
+// Tipos de paquete del protocolo UDP confiable:
+const (
+	PacketInit   = 1 // Inicio de una transferencia (cliente → servidor)
+	PacketData   = 2 // Fragmento de datos del archivo (cliente → servidor)
+	PacketAck    = 3 // Confirmación selectiva de fragmentos (servidor → cliente)
+	PacketResult = 4 // Estado final de la transferencia (servidor → cliente)
+)
+
+const (
+	maxDatagramSize = 65507                  // Tamaño máximo de la carga útil de un datagrama UDP
+	packetHeaderLen = 5                      // Tipo de paquete (1) + ID de transferencia (4)
+	udpChunkSize    = 1024                   // Tamaño de los fragmentos de datos, normal 1024, 8192
+	udpRetryTimeout = 300 * time.Millisecond // Tiempo de espera antes de retransmitir, hasta medir el RTT
+	udpMaxRetries   = 20                     // Esperas consecutivas sin progreso antes de abortar
+)
+
+// SendUDPFiles envía los archivos indicados al servidor especificado con workers trabajadores en
+// paralelo, y devuelve el resultado de cada uno. Cada archivo se envía en su propia sesión UDP.
+func SendUDPFiles(uploads []Upload, ipConn string, portConn string, workers int) []UploadResult {
+	return RunUploads(uploads, workers, func() uploader {
+		return udpUploader{ipConn, portConn}
+	})
+}
+
+// udpUploader envía archivos por UDP con SendUDPFile.
+type udpUploader struct {
+	ip   string
+	port string
+}
+
+// Send envía un archivo y devuelve la ruta con la que lo guardó el servidor.
+func (u udpUploader) Send(upload Upload, progress *FileProgress) (string, error) {
+	return SendUDPFile(upload, u.ip, u.port, progress)
+}
+
+// Close no hace nada, ya que cada sesión UDP se cierra al terminar su archivo.
+func (u udpUploader) Close() {}
+
+// SendUDPFile envía un archivo a través de una conexión UDP al servidor especificado y devuelve la ruta
+// con la que lo guardó el servidor.
+func SendUDPFile(upload Upload, ipConn string, portConn string, progress *FileProgress) (string, error) {
 	// Abre el archivo:
-	file, err := os.Open(filePath)
+	file, err := os.Open(upload.Path)
 	if err != nil {
-		return fmt.Errorf("error al abrir el archivo: %v", err)
+		return "", fmt.Errorf("error al abrir el archivo: %v", err)
 	}
 	defer file.Close()
 
 	// Obtiene los datos del archivo:
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("error al obtener información del archivo: %v", err)
-	}
-
-	fileName := fileInfo.Name()
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("error al leer los datos del archivo: %v", err)
+		return "", fmt.Errorf("error al obtener información del archivo: %v", err)
 	}
 
 	// Calcula el hash SHA-256 del archivo:
-	hash := sha256.Sum256(fileData)
-
-	// Crea la estructura del mensaje:
-	msg := FileMessage{
-		FileName: fileName,
-		Data:     fileData,
-		Hash:     hash,
+	hash, err := HashFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error al leer los datos del archivo: %v", err)
 	}
 
 	// Resuelve la dirección del servidor:
 	serverAddr, err := net.ResolveUDPAddr("udp", ipConn+":"+portConn)
 	if err != nil {
-		return fmt.Errorf("error al resolver la dirección UDP: %v", err)
+		return "", fmt.Errorf("error al resolver la dirección UDP: %v", err)
 	}
 
 	// Crea la conexión UDP:
 	conn, err := net.DialUDP("udp", nil, serverAddr)
 	if err != nil {
-		return fmt.Errorf("error al establecer la conexión UDP: %v", err)
+		return "", fmt.Errorf("error al establecer la conexión UDP: %v", err)
 	}
 	defer conn.Close()
 
-	// Codifica y envía el mensaje al servidor:
-	err = sendUDPMessage(conn, &msg)
+	// Codifica y envía el mensaje al servidor, que responde con el estado final de la transferencia:
+	sender := newUDPSender(conn, rand.Uint32(), file, upload.Name, fileInfo.Size(), hash)
+	sender.progress = progress
+	response, err := sender.send()
 	if err != nil {
-		return fmt.Errorf("error al enviar el mensaje por UDP: %v", err)
+		return "", fmt.Errorf("error al enviar el mensaje por UDP: %v", err)
 	}
 
-	// Respuesta del servidor:
-	response := make([]byte, 1)
-	_, err = conn.Read(response)
+	err = CheckResponse(response, hash)
 	if err != nil {
-		return fmt.Errorf("error al leer la respuesta del servidor: %v", err)
+		return "", err
 	}
+	return response.Path, nil
+}
+
+// udpSender contiene el estado del envío confiable de un archivo por UDP. Los fragmentos se leen
+// del archivo en disco cada vez que se envían, por lo que el archivo nunca se carga completo en memoria.
+type udpSender struct {
+	conn       *net.UDPConn
+	transferID uint32
+	file       io.ReaderAt         // Archivo del que se leen los fragmentos
+	fileName   string              // Nombre del archivo
+	fileSize   int64               // Tamaño total del archivo
+	hash       [32]byte            // Hash SHA-256 del archivo
+	numChunks  int                 // Cantidad total de fragmentos
+	acked      []bool              // Fragmentos confirmados por el servidor
+	base       int                 // Primer fragmento sin confirmar
+	next       int                 // Primer fragmento que nunca se ha enviado
+	inFlight   map[int]udpInFlight // Fragmentos enviados sin confirmar, por número de secuencia
+	lost       []int               // Fragmentos perdidos pendientes de retransmitir, en orden
+	sends      uint64              // Cantidad de fragmentos enviados, incluidas las retransmisiones
+	lastAcked  uint64              // Número del envío más reciente que el servidor confirmó
+	cc         *congestionControl  // Control de congestión, que decide cuántos fragmentos enviar y a qué ritmo
+	cipher     *udpCipher          // Cifrador de la sesión, nil si la transferencia no se cifra
+	progress   *FileProgress       // Avance del archivo, que suma los fragmentos confirmados
+}
 
-	if response[0] == MsgSuccess {
-		fmt.Println("El archivo se guardó correctamente.")
-	} else {
-		return fmt.Errorf("el archivo no se pudo guardar correctamente")
+// udpInFlight describe el último envío de un fragmento que el servidor no ha confirmado.
+type udpInFlight struct {
+	sentAt     time.Time // Momento del envío
+	send       uint64    // Número del envío, en el orden de todos los envíos de la transferencia
+	retransmit bool      // Indica si el fragmento ya se había enviado antes
+}
+
+// newUDPSender crea el estado del envío de un archivo con el ID de transferencia indicado.
+func newUDPSender(conn *net.UDPConn, transferID uint32, file io.ReaderAt, fileName string, fileSize int64, hash [32]byte) *udpSender {
+	numChunks := int((fileSize + udpChunkSize - 1) / udpChunkSize)
+	return &udpSender{
+		conn:       conn,
+		transferID: transferID,
+		file:       file,
+		fileName:   fileName,
+		fileSize:   fileSize,
+		hash:       hash,
+		numChunks:  numChunks,
+		acked:      make([]bool, numChunks),
+		inFlight:   make(map[int]udpInFlight),
+		cc:         newCongestionControl(),
 	}
+}
 
-	return nil
+// send envía un mensaje que contiene la información de un archivo a través de una conexión UDP.
+// Cada fragmento lleva el ID de la transferencia y su número de secuencia; los fragmentos que el
+// servidor no confirma se retransmiten hasta que el archivo completo llega, y la cantidad de fragmentos
+// en vuelo y el ritmo de envío se adaptan a las confirmaciones y pérdidas con congestionControl.
+// Devuelve la respuesta final enviada por el servidor o un error si ocurre algún problema durante el
+// proceso.
+func (s *udpSender) send() (Response, error) {
+	// Si se solicitó cifrado, se establece la llave de la sesión antes de enviar el archivo:
+	if GlobalOptions.UDPEncrypt {
+		err := s.handshake()
+		var rejected *ResponseError
+		if errors.As(err, &rejected) {
+			return rejected.Response, nil
+		}
+		if err != nil {
+			return Response{}, err
+		}
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	started := false // Indica si el servidor ya aceptó el paquete de inicio
+	retries := 0
+	for {
+		// Mientras el servidor no acepte la transferencia, o cuando ya se confirmaron todos los
+		// fragmentos pero falta el estado final, se reenvía el paquete de inicio:
+		var err error
+		paced := false // Indica si quedan fragmentos que solo esperan al ritmo de envío
+		if !started || s.base == s.numChunks {
+			err = s.sendInit()
+		} else {
+			paced, err = s.sendWindow()
+		}
+		if err != nil {
+			return Response{}, err
+		}
+
+		// Se espera la respuesta del servidor hasta que se agota el tiempo de espera o, si el ritmo de
+		// envío detuvo la ventana, hasta que se puede enviar el siguiente fragmento:
+		timeout := time.Now().Add(s.cc.rto)
+		deadline := timeout
+		if paced && s.cc.nextSend.Before(deadline) {
+			deadline = s.cc.nextSend
+		}
+		packet, err := s.read(buf, deadline)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if time.Now().Before(timeout) {
+					continue
+				}
+				retries++
+				if retries > udpMaxRetries {
+					return Response{}, fmt.Errorf("el servidor no respondió después de %d intentos", retries)
+				}
+				s.timeout()
+				continue
+			}
+			return Response{}, err
+		}
+		if packet == nil {
+			continue
+		}
+
+		switch packet[0] {
+		case PacketAck:
+			started = true
+			if s.handleAck(packet[packetHeaderLen:]) {
+				retries = 0
+			}
+		case PacketResult:
+			response, err := ReadResponse(bytes.NewReader(packet[packetHeaderLen:]))
+			if err != nil {
+				continue
+			}
+			return response, nil
+		}
+	}
 }
 
-// sendUDPMessage envía un mensaje que contiene la información de un archivo a través de una conexión UDP.
-// Devuelve un error si ocurre algún problema durante el proceso.
-func sendUDPMessage(conn *net.UDPConn, msg *FileMessage) error {
-	// Codifica la estructura del mensaje y lo envía a través de la conexión:
-	_, err := conn.Write([]byte{0}) // Indicador de inicio del mensaje
+// handshake intercambia llaves públicas efímeras con el servidor y deriva el cifrador de la sesión.
+// Devuelve un *ResponseError si el servidor rechaza la sesión.
+func (s *udpSender) handshake() error {
+	private, err := newClientKey()
 	if err != nil {
-		fmt.Println("[ERROR] al enviar indicador de inicio del mensaje: ", err)
 		return err
 	}
+	hello := make([]byte, packetHeaderLen+publicKeyLen)
+	hello[0] = PacketHello
+	binary.BigEndian.PutUint32(hello[1:5], s.transferID)
+	copy(hello[packetHeaderLen:], private.PublicKey().Bytes())
 
-	// Escribe el nombre del archivo en la conexión:
-	fileNameLenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(fileNameLenBuf, uint32(len(msg.FileName)))
-	_, err = conn.Write(fileNameLenBuf)
-	if err != nil {
-		fmt.Println("[ERROR] al enviar la longitud del nombre del archivo: ", err)
+	buf := make([]byte, maxDatagramSize)
+	for retries := 0; retries <= udpMaxRetries; retries++ {
+		_, err = s.conn.Write(hello)
+		if err != nil {
+			s.progress.Println("[ERROR] al enviar la llave pública: ", err)
+			return err
+		}
+
+		packet, err := s.read(buf, time.Now().Add(udpRetryTimeout))
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		// El servidor puede rechazar la sesión antes de establecer la llave, por ejemplo si hay demasiadas
+		// transferencias en curso desde esta dirección:
+		if packet != nil && packet[0] == PacketResult {
+			response, err := ReadResponse(bytes.NewReader(packet[packetHeaderLen:]))
+			if err == nil {
+				return &ResponseError{Response: response}
+			}
+			continue
+		}
+		if packet == nil || packet[0] != PacketHelloReply || len(packet) < packetHeaderLen+publicKeyLen {
+			continue
+		}
+
+		s.cipher, err = newClientCipher(s.transferID, private, packet[packetHeaderLen:packetHeaderLen+publicKeyLen], GlobalOptions.UDPPSK)
 		return err
 	}
+	return fmt.Errorf("el servidor no respondió al intercambio de llaves")
+}
 
-	// Envía el nombre del archivo:
-	_, err = conn.Write([]byte(msg.FileName))
+// read espera un paquete del servidor hasta deadline. Devuelve nil si el paquete no pertenece a la
+// transferencia o, en una sesión cifrada, si no está sellado con la llave de la sesión.
+func (s *udpSender) read(buf []byte, deadline time.Time) ([]byte, error) {
+	s.conn.SetReadDeadline(deadline)
+	n, err := s.conn.Read(buf)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar el nombre del archivo: ", err)
-		return err
+		return nil, err
 	}
+	packet := buf[:n]
+	if n < packetHeaderLen || binary.BigEndian.Uint32(packet[1:packetHeaderLen]) != s.transferID {
+		return nil, nil
+	}
+
+	if s.cipher == nil {
+		return packet, nil
+	}
+	if packet[0] != PacketSealed {
+		return nil, nil
+	}
+	packet, err = s.cipher.open(packet, directionServer)
+	if err != nil {
+		s.progress.Println("[ERROR] descartando paquete del servidor:", err)
+		return nil, nil
+	}
+	return packet, nil
+}
+
+// write envía un paquete al servidor, cifrado si la sesión está cifrada.
+func (s *udpSender) write(packet []byte) error {
+	if s.cipher != nil {
+		packet = s.cipher.seal(packet, directionClient)
+	}
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// sendInit envía el paquete de inicio con la versión del protocolo, el tamaño de los fragmentos,
+// el tamaño total, el hash, la política de colisión, la credencial del cliente y el nombre del archivo.
+func (s *udpSender) sendInit() error {
+	token := GlobalOptions.Token
+	packet := make([]byte, packetHeaderLen+1+4+8+32+1+2+2+len(token)+len(s.fileName))
+	packet[0] = PacketInit
+	binary.BigEndian.PutUint32(packet[1:5], s.transferID)
+	packet[5] = ProtocolVersion
+	binary.BigEndian.PutUint32(packet[6:10], uint32(udpChunkSize))
+	binary.BigEndian.PutUint64(packet[10:18], uint64(s.fileSize))
+	copy(packet[18:50], s.hash[:])
+	packet[50] = GlobalOptions.Collision
+	binary.BigEndian.PutUint16(packet[51:53], uint16(len(token)))
+	binary.BigEndian.PutUint16(packet[53:55], uint16(len(s.fileName)))
+	copy(packet[55:], token)
+	copy(packet[55+len(token):], s.fileName)
 
-	// Envía el tamaño total del archivo:
-	totalSizeBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(totalSizeBuf, uint32(len(msg.Data)))
-	_, err = conn.Write(totalSizeBuf)
+	err := s.write(packet)
 	if err != nil {
-		fmt.Println("[ERROR] al enviar la longitud total del archivo: ", err)
+		s.progress.Println("[ERROR] al enviar el paquete de inicio: ", err)
 		return err
 	}
+	return nil
+}
 
-	// Define el tamaño del fragmento
-	chunkSize := 1024 // 1024, 8192
-	dataLen := len(msg.Data)
+// sendWindow da por perdidos los fragmentos en vuelo que ya no se esperan y envía los fragmentos
+// perdidos, y después los que nunca se han enviado, mientras la ventana de congestión y el ritmo de envío
+// lo permiten. Devuelve true si quedan fragmentos que solo esperan al ritmo de envío.
+func (s *udpSender) sendWindow() (bool, error) {
+	now := time.Now()
+	s.detectLosses(now)
 
-	// Enviar fragmentos del archivo
-	for i := 0; i < dataLen; i += chunkSize {
-		end := i + chunkSize
-		if end > dataLen {
-			end = dataLen
+	for len(s.inFlight) < s.cc.window() {
+		// Los fragmentos que se confirmaron después de darse por perdidos ya no se retransmiten:
+		for len(s.lost) > 0 && s.acked[s.lost[0]] {
+			s.lost = s.lost[1:]
+		}
+		var seq int
+		retransmit := len(s.lost) > 0
+		switch {
+		case retransmit:
+			seq = s.lost[0]
+		case s.next < s.numChunks && s.next < s.base+udpMaxWindow:
+			seq = s.next
+		default:
+			return false, nil
+		}
+		if !s.cc.canSend(now) {
+			return true, nil
 		}
 
-		// Envía un fragmento del archivo:
-		_, err = conn.Write(msg.Data[i:end])
+		err := s.sendChunk(seq)
 		if err != nil {
-			fmt.Println("[ERROR] al enviar fragmento del archivo: ", err)
-			return err
+			s.progress.Println("[ERROR] al enviar fragmento del archivo: ", err)
+			return false, err
+		}
+		if retransmit {
+			s.lost = s.lost[1:]
+		} else {
+			s.next++
 		}
+		s.sends++
+		s.inFlight[seq] = udpInFlight{sentAt: now, send: s.sends, retransmit: retransmit}
+		s.cc.onSend(now)
 	}
+	return false, nil
+}
 
-	// Envía el hash del archivo en la conexión:
-	_, err = conn.Write(msg.Hash[:])
-	if err != nil {
-		fmt.Println("[ERROR] al enviar el hash del archivo: ", err)
+// detectLosses da por perdidos los fragmentos en vuelo que superaron el tiempo de espera o que se
+// enviaron antes que un fragmento ya confirmado y llevan en vuelo más que un RTT y un margen para los
+// datagramas que llegan desordenados, y reduce la ventana de congestión.
+func (s *udpSender) detectLosses(now time.Time) {
+	found := false
+	reordered := s.cc.latestRTT + s.cc.srtt/4
+	for seq, f := range s.inFlight {
+		age := now.Sub(f.sentAt)
+		if (s.cc.srtt != 0 && f.send < s.lastAcked && age >= reordered) || age >= s.cc.rto {
+			delete(s.inFlight, seq)
+			s.lost = append(s.lost, seq)
+			s.cc.onLoss(f.send, s.sends)
+			found = true
+		}
+	}
+	if found {
+		slices.Sort(s.lost)
+	}
+}
+
+// timeout da por perdidos todos los fragmentos en vuelo cuando el servidor no responde durante todo el
+// tiempo de espera, y reinicia el control de congestión.
+func (s *udpSender) timeout() {
+	for seq := range s.inFlight {
+		s.lost = append(s.lost, seq)
+	}
+	clear(s.inFlight)
+	slices.Sort(s.lost)
+	s.cc.onTimeout(s.sends)
+}
+
+// sendChunk lee del archivo el fragmento con el número de secuencia indicado y lo envía cuando el límite
+// de tasa lo permite.
+func (s *udpSender) sendChunk(seq int) error {
+	start := int64(seq) * udpChunkSize
+	end := start + udpChunkSize
+	if end > s.fileSize {
+		end = s.fileSize
+	}
+
+	packet := make([]byte, packetHeaderLen+4+end-start)
+	packet[0] = PacketData
+	binary.BigEndian.PutUint32(packet[1:5], s.transferID)
+	binary.BigEndian.PutUint32(packet[5:9], uint32(seq))
+	_, err := s.file.ReadAt(packet[9:], start)
+	if err != nil && err != io.EOF {
 		return err
 	}
 
-	return nil
+	GlobalOptions.RateLimit.Wait(len(packet))
+	return s.write(packet)
+}
+
+// handleAck marca los fragmentos confirmados por el servidor. Devuelve true si la confirmación
+// contiene fragmentos que no se habían confirmado antes.
+func (s *udpSender) handleAck(payload []byte) bool {
+	if len(payload) < 6 {
+		return false
+	}
+	base := int(binary.BigEndian.Uint32(payload[0:4]))
+	bitmapLen := int(binary.BigEndian.Uint16(payload[4:6]))
+	if len(payload) < 6+bitmapLen || base > s.numChunks {
+		return false
+	}
+	bitmap := payload[6 : 6+bitmapLen]
+
+	acked := 0
+	var latest udpInFlight // Envío más reciente entre los fragmentos confirmados, con el que se mide el RTT
+	ack := func(seq int) {
+		if seq < s.numChunks && !s.acked[seq] {
+			s.acked[seq] = true
+			if f, ok := s.inFlight[seq]; ok {
+				delete(s.inFlight, seq)
+				if f.send > latest.send {
+					latest = f
+				}
+			}
+			acked++
+			s.progress.Add(min(udpChunkSize, s.fileSize-int64(seq)*udpChunkSize))
+		}
+	}
+
+	// Todos los fragmentos anteriores a base fueron recibidos:
+	for seq := s.base; seq < base; seq++ {
+		ack(seq)
+	}
+	// El bit i del mapa indica si se recibió el fragmento base+1+i:
+	for i := 0; i < bitmapLen*8; i++ {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			ack(base + 1 + i)
+		}
+	}
+
+	for s.base < s.numChunks && s.acked[s.base] {
+		s.base++
+	}
+	if acked == 0 {
+		return false
+	}
+
+	// El RTT solo se mide con fragmentos enviados una vez, ya que la confirmación de uno retransmitido
+	// puede corresponder a cualquiera de sus envíos:
+	if latest.send > s.lastAcked {
+		s.lastAcked = latest.send
+		if !latest.retransmit {
+			s.cc.onRTT(time.Since(latest.sentAt))
+		}
+	}
+	s.cc.onAck(acked)
+	return true
 }
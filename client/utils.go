@@ -1,8 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
 )
 
 // Datos de conexión predeterminados:
@@ -12,16 +24,319 @@ const (
 	ConnType = "tcp"
 )
 
+// ProtocolVersion es la versión del protocolo de transferencia; es el primer byte de cada mensaje.
+const ProtocolVersion = 7
+
+// Códigos de estado que el servidor envía para indicar el resultado de una operación.
+const (
+	MsgSuccess         = 1
+	MsgFailure         = 0
+	MsgUnauthorized    = 2
+	MsgBadRequest      = 3
+	MsgInvalidType     = 4
+	MsgHashMismatch    = 5
+	MsgStorageError    = 6
+	MsgBusy            = 7
+	MsgExists          = 8
+	MsgContentMismatch = 9
+	MsgTooLarge        = 10
+	MsgQuotaExceeded   = 11
+	MsgNotFound        = 12
+)
+
+// Operaciones que el cliente puede solicitar en una conexión TCP; es el segundo byte de cada mensaje.
 const (
-	MsgSuccess = 1
-	MsgFailure = 0
+	OpUpload = 1 // Sube un archivo
+	OpUsage  = 2 // Consulta el uso de almacenamiento
+	OpGet    = 3 // Descarga un archivo guardado
+	OpList   = 4 // Lista los archivos guardados
+	OpDelete = 5 // Elimina un archivo guardado
+	OpRename = 6 // Cambia el nombre de un archivo guardado
 )
 
-// FileMessage representa la estructura del mensaje multimedia.
-type FileMessage struct {
-	FileName string
-	Data     []byte
-	Hash     [32]byte
+// MaxBodyLen es el tamaño máximo de los datos adicionales que se aceptan en una respuesta del servidor.
+const MaxBodyLen = 64 << 20
+
+// Políticas de colisión que el cliente puede solicitar cuando el archivo ya existe en el servidor:
+const (
+	CollisionDefault   = 0 // Política configurada en el servidor
+	CollisionOverwrite = 1 // Reemplaza el archivo existente
+	CollisionReject    = 2 // Rechaza la subida
+	CollisionRename    = 3 // Guarda el archivo nuevo con un sufijo numérico
+	CollisionVersion   = 4 // Conserva el archivo existente como una versión anterior
+)
+
+// UploadKeepPath es la opción de subida que pide al servidor conservar los subdirectorios del nombre del
+// archivo.
+const UploadKeepPath = 1
+
+// CollisionPolicies asocia el nombre de cada política de colisión con su código.
+var CollisionPolicies = map[string]byte{
+	"":          CollisionDefault,
+	"overwrite": CollisionOverwrite,
+	"reject":    CollisionReject,
+	"rename":    CollisionRename,
+	"version":   CollisionVersion,
+}
+
+// Response representa la respuesta del servidor al final de una operación.
+type Response struct {
+	Status byte     // Código de estado de la operación
+	Reason string   // Descripción legible del resultado
+	Path   string   // Ruta final del archivo en el servidor
+	Hash   [32]byte // Hash SHA-256 calculado por el servidor
+	Body   []byte   // Datos adicionales de la operación, por ejemplo el reporte de uso en JSON
+}
+
+// ResponseError es el error devuelto cuando el servidor responde con un código de estado distinto de MsgSuccess.
+type ResponseError struct {
+	Response Response
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("el servidor rechazó la operación: %s (código %d)", e.Response.Reason, e.Response.Status)
+}
+
+// ClientOptions contiene las opciones del cliente indicadas por línea de comandos.
+type ClientOptions struct {
+	Token      string       // Token de acceso que se envía al servidor en cada mensaje
+	TLSConfig  *tls.Config  // Configuración TLS para las conexiones TCP, nil si no se cifran
+	UDPEncrypt bool         // Cifra las transferencias UDP
+	UDPPSK     string       // Llave precompartida que autentica las sesiones UDP cifradas
+	Collision  byte         // Política de colisión solicitada al servidor
+	KeepPaths  bool         // Conserva en el servidor las rutas relativas de los archivos de un directorio
+	Progress   int          // Forma de mostrar el avance de las subidas: ProgressNone, ProgressBar o ProgressJSON
+	Quiet      bool         // Solo imprime los errores de las subidas
+	RateLimit  *RateLimiter // Límite de la tasa de transferencia de todas las conexiones, nil si no hay límite
+}
+
+// Upload es un archivo local que se va a subir.
+type Upload struct {
+	Path string // Ruta local del archivo
+	Name string // Nombre con el que se envía al servidor; incluye la ruta relativa si se conservan las rutas
+}
+
+// UploadResult es el resultado de la subida de un archivo.
+type UploadResult struct {
+	Upload
+	Path string // Ruta con la que el servidor guardó el archivo
+	Err  error  // Error de la subida, nil si el archivo se guardó
+}
+
+// GlobalOptions contiene las opciones globales del cliente.
+var GlobalOptions ClientOptions
+
+// Commands contiene los comandos del cliente; si el primer argumento no es un comando, es la ruta del
+// archivo que se sube.
+var Commands = []string{"put", "get", "ls", "rm", "mv", "usage"}
+
+// contains verifica si un valor está presente en un slice de strings.
+func contains(value string, array []string) bool {
+	for _, v := range array {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectUploads convierte las rutas indicadas por el usuario en la lista de archivos que se suben. Cada
+// ruta puede ser un archivo, un patrón glob o un directorio, que se recorre recursivamente omitiendo los
+// archivos y directorios ocultos. Los archivos se envían con su nombre o, si keepPaths es true, con su
+// ruta relativa al directorio que contiene la ruta indicada (por ejemplo, fotos/2024/a.jpg al subir el
+// directorio fotos).
+func CollectUploads(paths []string, keepPaths bool) ([]Upload, error) {
+	var uploads []Upload
+	for _, arg := range paths {
+		// Se expande el patrón, salvo que exista un archivo con ese nombre:
+		matches := []string{arg}
+		if _, err := os.Stat(arg); err != nil && strings.ContainsAny(arg, "*?[") {
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("patrón no válido: %s", arg)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("ningún archivo coincide con %s", arg)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("ruta del archivo no válida: %s", match)
+			}
+			if !info.IsDir() {
+				uploads = append(uploads, Upload{Path: match, Name: filepath.Base(match)})
+				continue
+			}
+
+			root := filepath.Clean(match)
+			err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
+				}
+				if !d.Type().IsRegular() {
+					return nil
+				}
+				name := d.Name()
+				if keepPaths {
+					rel, err := filepath.Rel(filepath.Dir(root), path)
+					if err != nil {
+						return err
+					}
+					name = filepath.ToSlash(rel)
+				}
+				uploads = append(uploads, Upload{Path: path, Name: name})
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error al recorrer el directorio %s: %v", match, err)
+			}
+		}
+	}
+	if len(uploads) == 0 {
+		return nil, fmt.Errorf("no hay archivos para subir")
+	}
+	return uploads, nil
+}
+
+// uploader envía archivos al servidor; cada trabajador de RunUploads usa el suyo.
+type uploader interface {
+	Send(upload Upload, progress *FileProgress) (string, error) // Envía un archivo y devuelve la ruta con la que se guardó
+	Close()                                                     // Libera la conexión del trabajador
+}
+
+// RunUploads sube los archivos con workers trabajadores en paralelo, cada uno con el uploader que crea
+// newUploader, y devuelve el resultado de cada archivo en el mismo orden. Los archivos pendientes se
+// reparten por una cola acotada. Mientras tanto se muestra el avance según GlobalOptions.Progress y, si
+// hay más de un archivo, el resultado de cada uno en el orden de la lista conforme terminan las
+// subidas, aunque terminen en otro orden.
+func RunUploads(uploads []Upload, workers int, newUploader func() uploader) []UploadResult {
+	results := make([]UploadResult, len(uploads))
+
+	// El avance total se calcula con el tamaño de todos los archivos:
+	var total int64
+	sizes := make([]int64, len(uploads))
+	for i, upload := range uploads {
+		if info, err := os.Stat(upload.Path); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	progress := NewProgress(GlobalOptions.Progress, len(uploads), total)
+
+	jobs := make(chan int, workers) // Índices de los archivos pendientes
+	done := make(chan int)          // Índices de los archivos terminados
+	go func() {
+		for i := range uploads {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(uploads)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := newUploader()
+			defer u.Close()
+			for i := range jobs {
+				fileProgress := progress.File(sizes[i])
+				results[i].Upload = uploads[i]
+				results[i].Path, results[i].Err = u.Send(uploads[i], fileProgress)
+				fileProgress.Done()
+				done <- i
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Se imprime el avance en orden: un archivo se reporta cuando él y todos los anteriores terminaron:
+	finished := make([]bool, len(uploads))
+	next := 0
+	for i := range done {
+		finished[i] = true
+		for ; next < len(uploads) && finished[next]; next++ {
+			result := results[next]
+			if GlobalOptions.Progress == ProgressJSON {
+				event := map[string]any{"event": "file", "index": next + 1, "path": result.Upload.Path, "status": "saved", "serverPath": result.Path}
+				if result.Err != nil {
+					event["status"], event["error"] = "error", result.Err.Error()
+				}
+				progress.Event(event)
+				continue
+			}
+			if len(uploads) == 1 || GlobalOptions.Quiet {
+				continue
+			}
+			status := "guardado"
+			if result.Err != nil {
+				status = "error"
+			}
+			progress.Println(fmt.Sprintf("[%d/%d] %s: %s", next+1, len(uploads), result.Upload.Path, status))
+		}
+	}
+	progress.Finish()
+	return results
+}
+
+// ReportUploads imprime el resultado de las subidas y devuelve el código de salida del cliente: 0 si
+// todas se guardaron o, si no, el del primer error en el orden de la lista, sin importar en qué orden
+// terminaron. Con varios archivos imprime un resumen por archivo. En modo silencioso solo imprime los
+// errores y con el avance en JSON no imprime nada, ya que cada resultado se reportó como un evento.
+func ReportUploads(results []UploadResult) int {
+	if GlobalOptions.Progress == ProgressJSON || GlobalOptions.Quiet {
+		code := 0
+		for _, result := range results {
+			if result.Err == nil {
+				continue
+			}
+			if GlobalOptions.Quiet && GlobalOptions.Progress != ProgressJSON {
+				fmt.Printf("Error al enviar el archivo %s: %v\n", result.Upload.Path, result.Err)
+			}
+			if code == 0 {
+				code = ExitCode(result.Err)
+			}
+		}
+		return code
+	}
+
+	if len(results) == 1 {
+		if results[0].Err != nil {
+			fmt.Println("Error al enviar el archivo:", results[0].Err)
+			return ExitCode(results[0].Err)
+		}
+		fmt.Println("El archivo se guardó correctamente en", results[0].Path)
+		return 0
+	}
+
+	code, saved := 0, 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARCHIVO\tRESULTADO")
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(w, "%s\terror: %v\n", result.Upload.Path, result.Err)
+			if code == 0 {
+				code = ExitCode(result.Err)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s\tguardado en %s\n", result.Upload.Path, result.Path)
+		saved++
+	}
+	w.Flush()
+	fmt.Printf("Se guardaron %d de %d archivos.\n", saved, len(results))
+	return code
 }
 
 // IsValidIP verifica si la cadena proporcionada es una dirección IP válida o "localhost".
@@ -47,9 +362,141 @@ func IsValidPort(port string, connType string) bool {
 	return false
 }
 
-// IsValidFilePath verifica si la ruta del archivo proporcionada es válida y existe.
-// Devuelve true si es válida y existe, de lo contrario, devuelve false.
-func IsValidFilePath(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// ReadResponse decodifica una respuesta del servidor: estado (1), longitud de la razón (2), razón,
+// longitud de la ruta (2), ruta, hash (32), longitud de los datos adicionales (4) y datos adicionales.
+func ReadResponse(r io.Reader) (Response, error) {
+	var response Response
+	status := make([]byte, 1)
+	_, err := io.ReadFull(r, status)
+	if err != nil {
+		return response, err
+	}
+	return readResponseFields(r, status[0])
+}
+
+// readResponseFields decodifica el resto de una respuesta cuyo código de estado ya se leyó.
+func readResponseFields(r io.Reader, status byte) (Response, error) {
+	response := Response{Status: status}
+	reason, err := readString16(r)
+	if err != nil {
+		return response, err
+	}
+	response.Reason = reason
+	path, err := readString16(r)
+	if err != nil {
+		return response, err
+	}
+	response.Path = path
+	_, err = io.ReadFull(r, response.Hash[:])
+	if err != nil {
+		return response, err
+	}
+
+	bodyLenBuf := make([]byte, 4)
+	_, err = io.ReadFull(r, bodyLenBuf)
+	if err != nil {
+		return response, err
+	}
+	bodyLen := binary.BigEndian.Uint32(bodyLenBuf)
+	if bodyLen > MaxBodyLen {
+		return response, fmt.Errorf("la respuesta del servidor supera %d bytes", MaxBodyLen)
+	}
+	response.Body = make([]byte, bodyLen)
+	_, err = io.ReadFull(r, response.Body)
+	return response, err
+}
+
+// readString16 lee una cadena precedida por su longitud en 2 bytes.
+func readString16(r io.Reader) (string, error) {
+	lenBuf := make([]byte, 2)
+	_, err := io.ReadFull(r, lenBuf)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// appendString16 agrega a buf la cadena s precedida por su longitud en 2 bytes.
+func appendString16(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// FormatBytes da formato a una cantidad de bytes con la unidad binaria más adecuada (KiB, MiB, ...).
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// CheckResponse devuelve un *ResponseError si la respuesta no es exitosa o si el hash calculado por
+// el servidor no coincide con el hash local del archivo.
+func CheckResponse(response Response, hash [32]byte) error {
+	if response.Status != MsgSuccess {
+		return &ResponseError{Response: response}
+	}
+	if response.Hash != hash {
+		return fmt.Errorf("el hash calculado por el servidor no coincide con el del archivo local")
+	}
+	return nil
+}
+
+// ExitCode devuelve el código de salida del cliente para un error: 10 más el código de estado si el
+// servidor rechazó la operación, o 1 en cualquier otro caso.
+func ExitCode(err error) int {
+	var responseErr *ResponseError
+	if errors.As(err, &responseErr) {
+		return 10 + int(responseErr.Response.Status)
+	}
+	return 1
+}
+
+// HashFile calcula el hash SHA-256 de los datos leídos de file, sin cargarlos completos en memoria.
+func HashFile(file io.Reader) ([32]byte, error) {
+	var hash [32]byte
+	hasher := sha256.New()
+	_, err := io.Copy(hasher, file)
+	if err != nil {
+		return hash, err
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return hash, nil
+}
+
+// LoadTLSConfig crea la configuración TLS del cliente. caFile es un bundle de CA para verificar el
+// certificado del servidor (si está vacío se usan las CA del sistema) y certFile/keyFile son el
+// certificado y la llave del cliente para TLS mutuo, opcionales.
+func LoadTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error al leer el bundle de CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("el bundle de CA no contiene certificados válidos")
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error al cargar el certificado del cliente: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
 }
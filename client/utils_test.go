@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pkiDir contiene la CA y los certificados de prueba; se generan con testdata/pki/gen.go.
+const pkiDir = "../testdata/pki"
+
+// dialTLS se conecta con clientConfig a un servidor TLS en 127.0.0.1 con serverConfig y lee un mensaje
+// del servidor. Devuelve el error del lado del cliente.
+func dialTLS(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("hola"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Con TLS 1.3 el servidor verifica el certificado del cliente después de que el cliente termina el
+	// saludo, así que un rechazo aparece al leer:
+	message := make([]byte, 4)
+	_, err = io.ReadFull(conn, message)
+	if err == nil && string(message) != "hola" {
+		err = fmt.Errorf("mensaje inesperado: %q", message)
+	}
+	return err
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(pkiDir, "server.pem"), filepath.Join(pkiDir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := os.ReadFile(filepath.Join(pkiDir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+
+	ca := filepath.Join(pkiDir, "ca.pem")
+	cert := filepath.Join(pkiDir, "client.pem")
+	key := filepath.Join(pkiDir, "client-key.pem")
+	tests := []struct {
+		name     string
+		caFile   string // Bundle de CA del cliente; vacío usa las CA del sistema
+		certFile string // Certificado del cliente; vacío si no presenta uno
+		keyFile  string
+		mutual   bool // El servidor exige el certificado del cliente
+		wantErr  bool
+	}{
+		{"TLS", ca, "", "", false, false},
+		{"TLS sin la CA del servidor", "", "", "", false, true},
+		{"TLS mutuo", ca, cert, key, true, false},
+		{"TLS mutuo sin certificado de cliente", ca, "", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig, err := LoadTLSConfig(tt.caFile, tt.certFile, tt.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			if tt.mutual {
+				serverConfig.ClientCAs = clientCAs
+				serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			err = dialTLS(t, serverConfig, clientConfig)
+			if tt.wantErr && err == nil {
+				t.Fatal("la conexión se estableció, se esperaba un rechazo")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("la conexión falló: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+	}{
+		{"CA inexistente", filepath.Join(t.TempDir(), "missing.pem"), "", ""},
+		{"CA sin certificados", filepath.Join(pkiDir, "client-key.pem"), "", ""},
+		{"certificado sin llave", "", filepath.Join(pkiDir, "client.pem"), ""},
+		{"llave que no corresponde", "", filepath.Join(pkiDir, "client.pem"), filepath.Join(pkiDir, "server-key.pem")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadTLSConfig(tt.caFile, tt.certFile, tt.keyFile)
+			if err == nil {
+				t.Fatal("LoadTLSConfig no devolvió un error")
+			}
+		})
+	}
+}
@@ -1,3 +1,10 @@
 module server
 
 go 1.21.6
+
+require (
+	golang.org/x/crypto v0.17.0
+	golang.org/x/text v0.14.0
+)
+
+require golang.org/x/sys v0.15.0 // indirect
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Límites de la paginación de un listado:
+const (
+	DefaultListLimit = 100  // Cantidad de archivos por página si el cliente no la indica
+	MaxListLimit     = 1000 // Cantidad máxima de archivos por página
+)
+
+// FileInfo describe un archivo guardado en el servidor.
+type FileInfo struct {
+	Category string `json:"category"` // Nombre de la categoría del archivo
+	Name     string `json:"name"`     // Nombre del archivo
+	Size     int64  `json:"size"`     // Tamaño en bytes
+	ModTime  int64  `json:"modTime"`  // Fecha de la última modificación, en segundos desde la época Unix
+	Hash     string `json:"hash"`     // Hash SHA-256 del contenido, en hexadecimal
+	path     string // Ruta del archivo en el servidor
+}
+
+// FileList es la respuesta a un listado: una página de archivos y la cantidad total que coincide con
+// el filtro.
+type FileList struct {
+	Files  []FileInfo `json:"files"`
+	Offset int        `json:"offset"` // Posición del primer archivo de la página
+	Total  int        `json:"total"`  // Cantidad de archivos que coinciden con el filtro
+}
+
+// ListFiles devuelve los archivos guardados en la categoría indicada, o en todas si está vacía, cuyo
+// nombre o último componente coincide con pattern (un patrón glob; vacío coincide con todos). Los
+// archivos se ordenan por categoría y nombre, y solo se devuelven limit archivos a partir de offset; el
+// hash solo se calcula para los archivos de la página. Devuelve un *UploadError si la categoría no
+// existe o el patrón no es válido.
+func ListFiles(categoryName, pattern string, offset, limit int) (FileList, error) {
+	list := FileList{Files: []FileInfo{}, Offset: offset}
+	if pattern != "" {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return list, &UploadError{MsgBadRequest, "patrón no válido: " + pattern}
+		}
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	var names []string
+	if categoryName != "" {
+		if _, ok := GlobalConfig.Categories[categoryName]; !ok {
+			return list, &UploadError{MsgNotFound, "categoría no encontrada: " + categoryName}
+		}
+		names = []string{categoryName}
+	} else {
+		for name := range GlobalConfig.Categories {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	// Se reúnen los archivos que coinciden con el filtro; cada categoría guarda sus archivos en una
+	// subcarpeta por extensión, que puede tener subdirectorios si las subidas los conservaron:
+	var files []FileInfo
+	for _, name := range names {
+		category := GlobalConfig.Categories[name]
+		var categoryFiles []FileInfo
+		for _, ext := range category.Extensions {
+			dir := filepath.Join(category.Path, ext)
+			err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil // El directorio no existe o el archivo se eliminó mientras se recorría
+					}
+					return err
+				}
+				// Se omiten los archivos y directorios ocultos (parciales y temporales):
+				if path != dir && strings.HasPrefix(d.Name(), ".") {
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
+				}
+				if !d.Type().IsRegular() {
+					return nil
+				}
+
+				// El patrón se compara con el nombre relativo al directorio de la extensión y con el
+				// último componente:
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				if pattern != "" {
+					matchRel, _ := filepath.Match(pattern, rel)
+					matchBase, _ := filepath.Match(pattern, d.Name())
+					if !matchRel && !matchBase {
+						return nil
+					}
+				}
+				info, err := d.Info()
+				if err != nil {
+					return nil // El archivo se eliminó mientras se recorría el directorio
+				}
+				categoryFiles = append(categoryFiles, FileInfo{
+					Category: name,
+					Name:     rel,
+					Size:     info.Size(),
+					ModTime:  info.ModTime().Unix(),
+					path:     path,
+				})
+				return nil
+			})
+			if err != nil {
+				return list, fmt.Errorf("al leer el directorio %s: %w", dir, err)
+			}
+		}
+		sort.Slice(categoryFiles, func(i, j int) bool {
+			return categoryFiles[i].Name < categoryFiles[j].Name
+		})
+		files = append(files, categoryFiles...)
+	}
+
+	list.Total = len(files)
+	if offset < 0 || offset >= len(files) {
+		return list, nil
+	}
+	files = files[offset:min(offset+limit, len(files))]
+
+	for _, file := range files {
+		hash, err := HashFile(file.path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return list, err
+		}
+		file.Hash = hex.EncodeToString(hash[:])
+		list.Files = append(list.Files, file)
+	}
+	return list, nil
+}
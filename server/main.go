@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -13,6 +19,17 @@ func main() {
 		fmt.Println("[ERROR] al leer el archivo de configuración:", err)
 		return
 	}
+
+	// Calcula el uso de almacenamiento actual para aplicar las cuotas:
+	err = Usage.Load()
+	if err != nil {
+		fmt.Println("[ERROR] al calcular el uso de almacenamiento:", err)
+		return
+	}
+
+	// Elimina los archivos parciales de las subidas que no se reanudaron a tiempo:
+	go ExpirePartials()
+
 	fmt.Println("Logs:")
 	host := GlobalConfig.Host
 	tcpPort := strconv.Itoa(GlobalConfig.TcpPort)
@@ -21,13 +38,26 @@ func main() {
 	// Inicia el listener del TCP con una goroutine:
 	go func() {
 		fmt.Println("> Arrancando servidor TCP en " + host + ":" + tcpPort)
-		tcpListener, err := net.Listen("tcp", host+":"+tcpPort)
+		// Los sondeos keep-alive detectan los clientes que desaparecen sin cerrar la conexión:
+		listenConfig := net.ListenConfig{KeepAlive: time.Duration(GlobalConfig.TCPKeepAlive) * time.Second}
+		tcpListener, err := listenConfig.Listen(context.Background(), "tcp", host+":"+tcpPort)
 		if err != nil {
 			fmt.Println("[ERROR] al iniciar el listener del protocolo TCP: ", err)
 			return
 		}
 		defer tcpListener.Close()
 
+		// Si se configuró un certificado, las conexiones TCP se cifran con TLS:
+		tlsConfig, err := LoadTLSConfig()
+		if err != nil {
+			fmt.Println("[ERROR] al configurar TLS: ", err)
+			return
+		}
+		if tlsConfig != nil {
+			tcpListener = tls.NewListener(tcpListener, tlsConfig)
+			fmt.Println("\t>> TLS habilitado para el servidor TCP")
+		}
+
 		fmt.Println("\t>> Servidor TCP escuchando en puerto: " + tcpPort)
 
 		for {
@@ -55,12 +85,19 @@ func main() {
 		defer udpListener.Close()
 
 		fmt.Println("\t>> Servidor UDP escuchando en puerto: " + udpPort)
+		if GlobalConfig.UdpEncryption && GlobalConfig.UdpPSK == "" {
+			fmt.Println("[ADVERTENCIA] udpEncryption sin udpPSK: el cifrado UDP protege de quien escucha el tráfico, pero no de un atacante que se haga pasar por el servidor y lea las credenciales de los clientes.")
+		}
 
+		buf := make([]byte, maxDatagramSize)
 		for {
-			HandleUDP(udpListener)
+			HandleUDP(udpListener, buf)
 		}
 	}()
 
-	// Permite esperar indefinidamente:
-	select {}
+	// Espera hasta que se detiene el servidor y guarda los cambios pendientes del registro de uso:
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	Usage.Flush()
 }
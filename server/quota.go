@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileOwner registra qué cliente subió un archivo y cuántos bytes ocupa.
+type fileOwner struct {
+	Client string `json:"client"` // Nombre del cliente que subió el archivo
+	Size   int64  `json:"size"`   // Tamaño del archivo en bytes
+}
+
+// usageTracker lleva la cuenta de los bytes guardados por categoría y por cliente, y de los bytes
+// reservados por las subidas en curso, para aplicar las cuotas antes de recibir los datos.
+type usageTracker struct {
+	mu         sync.Mutex
+	categories map[string]int64     // Bytes guardados por categoría
+	clients    map[string]int64     // Bytes guardados por cliente
+	reserved   map[string]int64     // Bytes reservados por subidas en curso, por categoría y por cliente
+	files      map[string]fileOwner // Dueño de cada archivo subido, por ruta
+	saveTimer  *time.Timer          // Escritura programada del registro de dueños, nil si no hay cambios
+	saveMu     sync.Mutex           // Ordena las escrituras del registro de dueños
+}
+
+// usageSaveDelay es el tiempo durante el que se agrupan los cambios del registro de dueños antes de
+// escribirlo, para no reescribir el registro completo con cada archivo subido.
+const usageSaveDelay = time.Second
+
+// Usage contiene el uso de almacenamiento del servidor.
+var Usage = &usageTracker{
+	categories: make(map[string]int64),
+	clients:    make(map[string]int64),
+	reserved:   make(map[string]int64),
+	files:      make(map[string]fileOwner),
+}
+
+// Reservation es el espacio reservado por una subida en curso.
+type Reservation struct {
+	category      string // Categoría de la subida
+	client        string // Cliente que sube el archivo
+	categoryBytes int64  // Bytes reservados en la categoría
+	clientBytes   int64  // Bytes reservados en el cliente
+}
+
+// CategoryUsage describe el uso de almacenamiento de una categoría o de un cliente.
+type CategoryUsage struct {
+	Name  string `json:"name"`  // Nombre de la categoría o del cliente
+	Used  int64  `json:"used"`  // Bytes guardados
+	Quota int64  `json:"quota"` // Cuota en bytes; 0 indica que no hay límite
+}
+
+// UsageReport es la respuesta a una consulta de uso: el uso de cada categoría y el del cliente que
+// consulta, si está autenticado.
+type UsageReport struct {
+	Categories []CategoryUsage `json:"categories"`
+	Client     *CategoryUsage  `json:"client,omitempty"`
+}
+
+// Load calcula el uso de cada categoría recorriendo su directorio y lee el registro de dueños de los
+// archivos subidos. Se cuentan los archivos parciales de las subidas interrumpidas, que ocupan espacio
+// hasta que caducan, pero no los demás archivos ocultos, como los temporales.
+func (u *usageTracker) Load() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name, category := range GlobalConfig.Categories {
+		used := int64(0)
+		err := filepath.WalkDir(category.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.Type().IsRegular() && (!strings.HasPrefix(d.Name(), ".") || isPartialFile(d.Name())) {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				used += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("al calcular el uso de la categoría %s: %w", name, err)
+		}
+		u.categories[name] = used
+	}
+
+	data, err := os.ReadFile(GlobalConfig.UsageFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("al leer el registro de uso: %w", err)
+	}
+	err = json.Unmarshal(data, &u.files)
+	if err != nil {
+		return fmt.Errorf("al leer el registro de uso: %w", err)
+	}
+	for path, owner := range u.files {
+		// Se descartan los archivos que se eliminaron mientras el servidor no estaba en ejecución:
+		if _, err := os.Stat(path); err != nil {
+			delete(u.files, path)
+			continue
+		}
+		u.clients[owner.Client] += owner.Size
+	}
+	return nil
+}
+
+// ExpirePartials elimina los archivos parciales de las subidas interrumpidas que no se reanudaron en
+// GlobalConfig.PartialExpiry horas y los descuenta del uso. Los busca al iniciar el servidor y después
+// cada hora; no hace nada si PartialExpiry es negativo.
+func ExpirePartials() {
+	if GlobalConfig.PartialExpiry < 0 {
+		return
+	}
+	maxAge := time.Duration(GlobalConfig.PartialExpiry) * time.Hour
+	for {
+		dirs := map[string]string{"": GlobalConfig.StagingPath}
+		for name, category := range GlobalConfig.Categories {
+			dirs[name] = category.Path
+		}
+		for name, dir := range dirs {
+			err := expirePartials(dir, name, maxAge)
+			if err != nil {
+				fmt.Println("[ERROR] al eliminar archivos parciales caducados:", err)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// expirePartials elimina los archivos parciales de dir, de la categoría indicada, que no se modificaron
+// en maxAge y que ninguna conexión está recibiendo.
+func expirePartials(dir, category string, maxAge time.Duration) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || !isPartialFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			return nil
+		}
+
+		activeUploadsMu.Lock()
+		defer activeUploadsMu.Unlock()
+		if activeUploads[path] {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		Usage.Remove(path, category, info.Size())
+		return nil
+	})
+}
+
+// isPartialFile indica si name es el nombre de un archivo parcial, ver PartialFilePath.
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part")
+}
+
+// Reserve aparta size bytes en la categoría y en el cliente para una subida. Si la subida reemplazará
+// el archivo en replacePath, su tamaño se descuenta de la categoría y, si es del mismo cliente, también
+// del cliente. Devuelve un *UploadError con MsgQuotaExceeded si la subida superaría alguna de las dos
+// cuotas, contando las demás subidas en curso. La reserva se libera con Release al terminar la subida,
+// se haya guardado o no.
+func (u *usageTracker) Reserve(category, client string, size int64, replacePath string) (Reservation, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	r := Reservation{category: category, client: client, categoryBytes: size, clientBytes: size}
+	if replacePath != "" {
+		if info, err := os.Stat(replacePath); err == nil {
+			r.categoryBytes -= info.Size()
+			if owner, ok := u.files[replacePath]; ok && owner.Client == client {
+				r.clientBytes -= owner.Size
+			}
+		}
+	}
+
+	quota := GlobalConfig.Categories[category].Quota
+	used := u.categories[category] + u.reserved["category:"+category]
+	if quota > 0 && used+r.categoryBytes > quota {
+		return r, &UploadError{MsgQuotaExceeded, fmt.Sprintf("la categoría %s superaría su cuota de %d bytes (en uso: %d)", category, quota, used)}
+	}
+	quota = clientQuota(client)
+	used = u.clients[client] + u.reserved["client:"+client]
+	if quota > 0 && used+r.clientBytes > quota {
+		return r, &UploadError{MsgQuotaExceeded, fmt.Sprintf("el cliente %s superaría su cuota de %d bytes (en uso: %d)", client, quota, used)}
+	}
+
+	u.reserved["category:"+category] += r.categoryBytes
+	u.reserved["client:"+client] += r.clientBytes
+	return r, nil
+}
+
+// ReserveCategory aparta size bytes solo en la categoría, para una subida que su contenido enrutó a una
+// categoría distinta de la que cubre su reserva; el cliente ya tiene reservados esos bytes. Devuelve un
+// *UploadError con MsgQuotaExceeded si la subida superaría la cuota de la categoría.
+func (u *usageTracker) ReserveCategory(category string, size int64, replacePath string) (Reservation, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	r := Reservation{category: category, categoryBytes: size}
+	if replacePath != "" {
+		if info, err := os.Stat(replacePath); err == nil {
+			r.categoryBytes -= info.Size()
+		}
+	}
+
+	quota := GlobalConfig.Categories[category].Quota
+	used := u.categories[category] + u.reserved["category:"+category]
+	if quota > 0 && used+r.categoryBytes > quota {
+		return r, &UploadError{MsgQuotaExceeded, fmt.Sprintf("la categoría %s superaría su cuota de %d bytes (en uso: %d)", category, quota, used)}
+	}
+	u.reserved["category:"+category] += r.categoryBytes
+	return r, nil
+}
+
+// Release libera el espacio reservado con Reserve o ReserveCategory.
+func (u *usageTracker) Release(r Reservation) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reserved["category:"+r.category] -= r.categoryBytes
+	u.reserved["client:"+r.client] -= r.clientBytes
+}
+
+// Record registra un archivo de size bytes guardado en path por el cliente. replaced es el tamaño del
+// archivo que se reemplazó en esa ruta, o 0 si no existía.
+func (u *usageTracker) Record(path, category, client string, size, replaced int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.categories[category] += size - replaced
+	if owner, ok := u.files[path]; ok {
+		u.clients[owner.Client] -= owner.Size
+	}
+	u.files[path] = fileOwner{Client: client, Size: size}
+	u.clients[client] += size
+	u.save()
+}
+
+// Rename actualiza el registro cuando un archivo guardado cambia de ruta sin cambiar de categoría.
+func (u *usageTracker) Rename(oldPath, newPath string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	owner, ok := u.files[oldPath]
+	if !ok {
+		return
+	}
+	delete(u.files, oldPath)
+	u.files[newPath] = owner
+	u.save()
+}
+
+// Remove descuenta del uso el archivo de size bytes eliminado de path.
+func (u *usageTracker) Remove(path, category string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.categories[category] -= size
+	owner, ok := u.files[path]
+	if !ok {
+		return
+	}
+	u.clients[owner.Client] -= owner.Size
+	delete(u.files, path)
+	u.save()
+}
+
+// Report devuelve el uso de cada categoría y el del cliente indicado.
+func (u *usageTracker) Report(client string) UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var report UsageReport
+	for name, category := range GlobalConfig.Categories {
+		report.Categories = append(report.Categories, CategoryUsage{Name: name, Used: u.categories[name], Quota: category.Quota})
+	}
+	sort.Slice(report.Categories, func(i, j int) bool {
+		return report.Categories[i].Name < report.Categories[j].Name
+	})
+	if client != "" {
+		report.Client = &CategoryUsage{Name: client, Used: u.clients[client], Quota: clientQuota(client)}
+	}
+	return report
+}
+
+// save programa la escritura del registro de dueños de los archivos en GlobalConfig.UsageFile, que
+// agrupa los cambios de usageSaveDelay. Se llama con el mutex tomado.
+func (u *usageTracker) save() {
+	if u.saveTimer == nil {
+		u.saveTimer = time.AfterFunc(usageSaveDelay, u.Flush)
+	}
+}
+
+// Flush escribe en GlobalConfig.UsageFile los cambios pendientes del registro de dueños de los archivos.
+// El registro se codifica con el mutex tomado, pero se escribe sin él para no detener las subidas; si
+// falla, el uso en memoria sigue siendo correcto y solo se registra el error.
+func (u *usageTracker) Flush() {
+	u.saveMu.Lock()
+	defer u.saveMu.Unlock()
+
+	u.mu.Lock()
+	if u.saveTimer == nil {
+		u.mu.Unlock()
+		return
+	}
+	u.saveTimer.Stop()
+	u.saveTimer = nil
+	data, err := json.MarshalIndent(u.files, "", "  ")
+	u.mu.Unlock()
+	if err != nil {
+		fmt.Println("[ERROR] al codificar el registro de uso:", err)
+		return
+	}
+
+	data = append(data, '\n')
+	tmpPath := GlobalConfig.UsageFile + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, GlobalConfig.UsageFile)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] al guardar el registro de uso:", err)
+	}
+}
+
+// clientQuota devuelve la cuota configurada para el cliente, o 0 si no tiene límite.
+func clientQuota(client string) int64 {
+	for _, t := range GlobalConfig.Tokens {
+		if t.Name == client {
+			return t.Quota
+		}
+	}
+	return 0
+}
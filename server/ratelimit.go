@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateBurst es el tiempo de transferencia que un limitador puede acumular mientras no se usa; después de
+// una pausa solo se envían de golpe los bytes de ese tiempo.
+const rateBurst = 100 * time.Millisecond
+
+// RateLimiter limita la tasa de transferencia con una cubeta de fichas: las fichas se acumulan a rate
+// bytes por segundo, hasta los bytes de rateBurst, y cada transferencia las consume. Si no alcanzan,
+// la transferencia queda en deuda y espera el tiempo necesario para pagarla, de modo que las
+// transferencias que comparten el limitador se reparten la tasa. Un *RateLimiter nulo no limita nada.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // Bytes por segundo
+	burst  float64   // Fichas máximas acumuladas
+	tokens float64   // Fichas disponibles; negativo si hay transferencias esperando
+	last   time.Time // Última vez que se sumaron fichas
+}
+
+// NewRateLimiter crea un limitador de rate bytes por segundo. Devuelve nil si rate no es positivo.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) * rateBurst.Seconds()
+	return &RateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait consume n fichas y espera hasta que la tasa permita transferir n bytes.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Throttle aplica a las transferencias de un cliente el límite global del servidor y el del cliente.
+// Un *Throttle nulo no limita nada.
+type Throttle struct {
+	key    string       // Cliente al que pertenece el limitador, ver AcquireThrottle
+	global *RateLimiter // Límite de todas las transferencias del servidor
+	client *RateLimiter // Límite de las transferencias del cliente
+}
+
+// clientLimiter es el limitador de un cliente y la cantidad de transferencias que lo usan.
+type clientLimiter struct {
+	limiter *RateLimiter
+	users   int
+}
+
+// Limitadores compartidos por las transferencias en curso. El de cada cliente se crea con su primera
+// transferencia y se descarta con la última, para que las conexiones en paralelo de un cliente se
+// repartan su límite.
+var (
+	globalLimiter     *RateLimiter
+	globalLimiterOnce sync.Once
+	clientLimiters    = make(map[string]*clientLimiter)
+	clientLimitersMu  sync.Mutex
+)
+
+// AcquireThrottle devuelve el limitador de una transferencia del cliente indicado, identificado por su
+// nombre si se autenticó o, si no, por la IP de addr. Se debe liberar con Release al terminar la
+// transferencia. Devuelve nil si no se configuró ningún límite.
+func AcquireThrottle(client string, addr net.Addr) *Throttle {
+	globalLimiterOnce.Do(func() {
+		globalLimiter = NewRateLimiter(GlobalConfig.RateLimit)
+	})
+
+	rate := clientRateLimit(client)
+	if globalLimiter == nil && rate <= 0 {
+		return nil
+	}
+	t := &Throttle{global: globalLimiter}
+	if rate <= 0 {
+		return t
+	}
+
+	t.key = client
+	if t.key == "" {
+		t.key = addr.String()
+		if host, _, err := net.SplitHostPort(t.key); err == nil {
+			t.key = host
+		}
+	}
+	clientLimitersMu.Lock()
+	defer clientLimitersMu.Unlock()
+	entry, ok := clientLimiters[t.key]
+	if !ok {
+		entry = &clientLimiter{limiter: NewRateLimiter(rate)}
+		clientLimiters[t.key] = entry
+	}
+	entry.users++
+	t.client = entry.limiter
+	return t
+}
+
+// Release libera el limitador de la transferencia; el del cliente se descarta si ya no lo usa otra.
+func (t *Throttle) Release() {
+	if t == nil || t.client == nil {
+		return
+	}
+	clientLimitersMu.Lock()
+	defer clientLimitersMu.Unlock()
+	entry := clientLimiters[t.key]
+	entry.users--
+	if entry.users == 0 {
+		delete(clientLimiters, t.key)
+	}
+	t.client = nil
+}
+
+// Wait espera hasta que los límites global y del cliente permitan transferir n bytes.
+func (t *Throttle) Wait(n int) {
+	if t == nil {
+		return
+	}
+	t.global.Wait(n)
+	t.client.Wait(n)
+}
+
+// Reader devuelve un io.Reader que lee de r respetando los límites.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return throttledReader{r, t}
+}
+
+// Writer devuelve un io.Writer que escribe en w respetando los límites.
+func (t *Throttle) Writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return throttledWriter{w, t}
+}
+
+// throttledReader espera después de cada lectura el tiempo que corresponde a los bytes leídos.
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (tr throttledReader) Read(b []byte) (int, error) {
+	n, err := tr.r.Read(b)
+	tr.t.Wait(n)
+	return n, err
+}
+
+// throttledWriter espera antes de cada escritura el tiempo que corresponde a los bytes que escribe.
+type throttledWriter struct {
+	w io.Writer
+	t *Throttle
+}
+
+func (tw throttledWriter) Write(b []byte) (int, error) {
+	tw.t.Wait(len(b))
+	return tw.w.Write(b)
+}
+
+// clientRateLimit devuelve el límite en bytes por segundo configurado para el cliente, o 0 si no tiene
+// límite.
+func clientRateLimit(client string) int64 {
+	for _, t := range GlobalConfig.Tokens {
+		if t.Name == client && t.RateLimit > 0 {
+			return t.RateLimit
+		}
+	}
+	return GlobalConfig.ClientRateLimit
+}
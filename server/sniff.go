@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// sniffLen es la cantidad de bytes del inicio del archivo que se inspeccionan para detectar su tipo.
+const sniffLen = 512
+
+// MIME asignado a los datos que no coinciden con ninguna firma conocida.
+const unknownMIME = "application/octet-stream"
+
+// signature describe la firma de un tipo de archivo: su tipo MIME, las extensiones que le corresponden
+// (la primera es la que se usa al enrutar por contenido) y la función que reconoce sus primeros bytes.
+type signature struct {
+	mime  string
+	exts  []string
+	match func(head []byte) bool
+}
+
+// signatures contiene las firmas reconocidas por el servidor. El texto va al final porque solo se
+// reconoce por la ausencia de bytes binarios.
+var signatures = []signature{
+	{"image/png", []string{".png"}, prefix("\x89PNG\r\n\x1a\n")},
+	{"image/jpeg", []string{".jpg", ".jpeg"}, prefix("\xff\xd8\xff")},
+	{"audio/mpeg", []string{".mp3"}, isMP3},
+	{"audio/wav", []string{".wav"}, riff("WAVE")},
+	{"audio/midi", []string{".mid", ".midi"}, prefix("MThd")},
+	{"video/mp4", []string{".mp4"}, isMP4},
+	{"video/x-msvideo", []string{".avi"}, riff("AVI ")},
+	{"video/x-flv", []string{".flv"}, prefix("FLV\x01")},
+	{"application/pdf", []string{".pdf"}, prefix("%PDF-")},
+	{"application/zip", []string{".zip"}, prefix("PK\x03\x04")},
+	{"application/gzip", []string{".gz", ".tgz"}, prefix("\x1f\x8b")},
+	{"model/gltf-binary", []string{".glb"}, prefix("glTF")},
+	{"text/plain", []string{".txt"}, isText},
+}
+
+// DetectMIME devuelve el tipo MIME que corresponde a los primeros bytes de un archivo, o unknownMIME si
+// no coinciden con ninguna firma conocida.
+func DetectMIME(head []byte) string {
+	for _, s := range signatures {
+		if s.match(head) {
+			return s.mime
+		}
+	}
+	return unknownMIME
+}
+
+// SniffFile lee los primeros bytes del archivo en path y devuelve su tipo MIME. Devuelve una cadena
+// vacía si el archivo está vacío, ya que no hay contenido que inspeccionar.
+func SniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return DetectMIME(head[:n]), nil
+}
+
+// CheckContent inspecciona el archivo de size bytes recibido en path y lo compara con la extensión de
+// fileName y con los tipos MIME permitidos por su categoría. Devuelve el nombre y el directorio donde se
+// debe guardar: los mismos si el contenido coincide o, si está habilitado el enrutamiento por contenido,
+// los que corresponden al tipo detectado. Devuelve un *UploadError si el contenido no coincide con la
+// extensión o no está permitido.
+func CheckContent(path, fileName string, size int64) (string, string, error) {
+	mime, err := SniffFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Se acepta el archivo si coincide con su extensión, si está vacío o si la extensión no tiene una
+	// firma conocida y no hay forma de verificarla:
+	ext, category, valid := GetFileType(fileName)
+	expected := mimeForExt(strings.ToLower(ext))
+	if valid && (mime == "" || (expected == "" || mime == expected) && allowsMIME(category, mime)) {
+		dir, err := UploadDir(fileName, size)
+		return fileName, dir, err
+	}
+
+	if !GlobalConfig.RouteByContent {
+		if !valid {
+			return "", "", &UploadError{MsgInvalidType, "extensión de archivo no válida: " + ext}
+		}
+		if !allowsMIME(category, mime) {
+			return "", "", &UploadError{MsgContentMismatch, fmt.Sprintf("la categoría %s no permite el contenido %s", category.Name, mime)}
+		}
+		return "", "", &UploadError{MsgContentMismatch, fmt.Sprintf("el contenido del archivo (%s) no coincide con su extensión %s", mime, ext)}
+	}
+
+	// Se enruta el archivo según el tipo detectado, reemplazando su extensión:
+	routedExt := extForMIME(mime)
+	routedName := strings.TrimSuffix(fileName, ext) + routedExt
+	_, category, valid = GetFileType(routedName)
+	if routedExt == "" || !valid || !allowsMIME(category, mime) {
+		return "", "", &UploadError{MsgInvalidType, fmt.Sprintf("tipo de contenido no permitido: %s", mime)}
+	}
+	dir, err := UploadDir(routedName, size)
+	return routedName, dir, err
+}
+
+// allowsMIME indica si la categoría permite el tipo MIME detectado en el contenido de un archivo.
+func allowsMIME(category Category, mime string) bool {
+	return len(category.MimeTypes) == 0 || contains(mime, category.MimeTypes) != ""
+}
+
+// mimeForExt devuelve el tipo MIME que corresponde a la extensión ext, o una cadena vacía si no hay una
+// firma conocida para ella.
+func mimeForExt(ext string) string {
+	for _, s := range signatures {
+		if contains(ext, s.exts) != "" {
+			return s.mime
+		}
+	}
+	return ""
+}
+
+// extForMIME devuelve la extensión principal del tipo MIME indicado, o una cadena vacía si no se conoce.
+func extForMIME(mime string) string {
+	for _, s := range signatures {
+		if s.mime == mime {
+			return s.exts[0]
+		}
+	}
+	return ""
+}
+
+// prefix devuelve una función que reconoce los datos que empiezan con magic.
+func prefix(magic string) func([]byte) bool {
+	return func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte(magic))
+	}
+}
+
+// riff devuelve una función que reconoce un contenedor RIFF del formato indicado (WAVE, AVI, ...).
+func riff(format string) func([]byte) bool {
+	return func(head []byte) bool {
+		return len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == format
+	}
+}
+
+// isMP3 reconoce un archivo MP3 por su etiqueta ID3 o por la sincronización de la primera trama MPEG
+// de audio (11 bits en 1 y una capa distinta de la reservada).
+func isMP3(head []byte) bool {
+	if bytes.HasPrefix(head, []byte("ID3")) {
+		return true
+	}
+	return len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0 && head[1]&0x06 != 0
+}
+
+// isMP4 reconoce un archivo MP4 por la caja ftyp al inicio del archivo.
+func isMP4(head []byte) bool {
+	return len(head) >= 8 && string(head[4:8]) == "ftyp"
+}
+
+// isText reconoce texto UTF-8 sin caracteres de control, salvo los de espaciado. Una secuencia UTF-8
+// cortada al final de los bytes inspeccionados no se considera un error.
+func isText(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")) // Marca de orden de bytes UTF-8
+	for i := 0; i < len(head); {
+		r, size := utf8.DecodeRune(head[i:])
+		if r == utf8.RuneError && size == 1 {
+			return len(head)-i < utf8.UTFMax && !utf8.FullRune(head[i:])
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		i += size
+	}
+	return true
+}
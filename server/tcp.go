@@ -3,125 +3,527 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
+	"time"
 )
 
-// HandleTCP envuelve a handleTCPClient para manejar la recepción de archivos a través de una conexión TCP.
+// activeUploads contiene los archivos parciales que están recibiendo datos en este momento, para que
+// dos conexiones no escriban a la vez en el mismo archivo parcial.
+var (
+	activeUploads   = make(map[string]bool)
+	activeUploadsMu sync.Mutex
+)
+
+// HandleTCP atiende las operaciones que el cliente solicita en una conexión TCP, una tras otra, hasta
+// que el cliente cierra la conexión, envía un mensaje que no se puede leer completo o pasa más de
+// GlobalConfig.IdleTimeout segundos sin solicitar otra operación.
 func HandleTCP(conn net.Conn) {
-	status := handleTCPClient(conn)
-	// Se envía el estado de error de la operación al cliente:
-	err := sendTCPResponse(conn, status)
-	if err != nil {
-		fmt.Println("[ERROR] al enviar respuesta del estado de la operación al cliente: ", err)
+	defer conn.Close()
+	idleTimeout := time.Duration(GlobalConfig.IdleTimeout) * time.Second
+	for {
+		// Se recibe el encabezado con la versión del protocolo, la operación y la credencial; si el
+		// cliente cerró la conexión entre dos mensajes, no hay nada más que atender:
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		op, token, err := readRequestHeader(conn)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			LogEvent("Conexión inactiva cerrada:", conn.RemoteAddr().String())
+			return
+		}
+		// La operación en sí no tiene límite de tiempo, ya que un archivo grande puede tardar en llegar:
+		conn.SetReadDeadline(time.Time{})
+
+		var response Response
+		if err != nil {
+			response = badRequest(err)
+		} else {
+			response = handleTCPClient(conn, op, token)
+		}
+
+		// Se envía el estado de la operación al cliente:
+		err = sendTCPResponse(conn, response)
+		if response.File != nil {
+			response.File.Close()
+		}
+		response.Throttle.Release()
+		if err != nil {
+			fmt.Println("[ERROR] al enviar respuesta del estado de la operación al cliente: ", err)
+			return
+		}
+		if response.Close {
+			return
+		}
 	}
 }
 
-// handleTCPClient maneja la recepción de archivos a través de una conexión TCP.
-func handleTCPClient(conn net.Conn) byte {
-	// Se recibe la estructura del mensaje que contiene el nombre, los datos y el hash del archivo:
+// handleTCPClient verifica la credencial del cliente y atiende la operación solicitada.
+func handleTCPClient(conn net.Conn, op byte, token string) Response {
+	// Se verifica la credencial del cliente antes de aceptar cualquier dato; el resto del mensaje no
+	// se lee, así que la conexión se cierra:
+	client, ok := Authenticate(token)
+	if !ok {
+		response := Failure(MsgUnauthorized, "credencial no válida de "+conn.RemoteAddr().String())
+		response.Close = true
+		return response
+	}
+
+	switch op {
+	case OpUpload:
+		throttle := AcquireThrottle(client, conn.RemoteAddr())
+		defer throttle.Release()
+		return handleUpload(conn, client, throttle)
+	case OpUsage:
+		return handleUsage(client)
+	case OpGet:
+		response := handleGet(conn)
+		if response.File != nil {
+			response.Throttle = AcquireThrottle(client, conn.RemoteAddr())
+		}
+		return response
+	case OpList:
+		return handleList(conn)
+	case OpDelete:
+		return handleDelete(conn, client)
+	case OpRename:
+		return handleRename(conn, client)
+	default:
+		return badRequest(fmt.Errorf("operación no soportada: %d", op))
+	}
+}
+
+// badRequest devuelve la respuesta a un mensaje que no se pudo leer. Como no se sabe dónde empieza el
+// siguiente mensaje, la conexión se cierra después de enviarla.
+func badRequest(err error) Response {
+	response := Failure(MsgBadRequest, "mensaje no válido: "+err.Error())
+	response.Close = true
+	return response
+}
+
+// handleUpload maneja la recepción de un archivo a través de una conexión TCP. Los datos se escriben
+// en un archivo parcial identificado por el hash del archivo, que se conserva si la conexión se
+// interrumpe; cuando el cliente vuelve a enviar el mismo archivo, la subida continúa desde el último
+// byte recibido. Los datos se reciben a la tasa que permite throttle.
+func handleUpload(conn net.Conn, client string, throttle *Throttle) Response {
+	// Se recibe el encabezado de la subida que contiene el nombre, el tamaño y el hash del archivo:
 	var fileMsg FileMessage
 	err := readMessage(conn, &fileMsg)
 	if err != nil {
-		fmt.Println("[ERROR] leyendo el mensaje:", err)
-		return MsgFailure
+		return badRequest(err)
+	}
+	dataLen, hash := fileMsg.DataLen, fileMsg.Hash
+
+	// Se limpia el nombre del archivo para que no pueda salir del directorio de almacenamiento; si el
+	// cliente lo solicita, se conservan sus subdirectorios:
+	sanitize := SanitizeFileName
+	if fileMsg.Flags&UploadKeepPath != 0 {
+		sanitize = SanitizeFilePath
+	}
+	fileName, err := sanitize(fileMsg.FileName)
+	if err != nil {
+		return Failure(MsgBadRequest, err.Error())
 	}
 
 	// Crear un directorio para guardar el archivo basado en su tipo (imagen, audio, vídeo o texto):
-	fileType, filePath, valid := GetFileType(fileMsg.FileName)
-	if !valid {
-		fmt.Println("[ERROR] extensión de archivo no válida.")
-		return MsgFailure
+	dir, err := UploadDir(fileName, dataLen)
+	if err != nil {
+		return UploadFailure(err)
 	}
 
-	dir := filepath.Join(filePath, fileType)
 	err = os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
-		fmt.Println("[ERROR] creando directorio:", err)
-		return MsgFailure
+		return StorageFailure("creando directorio", err)
 	}
 
-	// Se verifica si el hash del archivo coincide con el enviado por el cliente:
-	err = CompareHash256(sha256.Sum256(fileMsg.Data), fileMsg.Hash)
+	if RejectsExisting(dir, fileName, fileMsg.Collision) {
+		return Failure(MsgExists, "el archivo ya existe: "+fileName)
+	}
+
+	// Se reserva el archivo parcial para esta conexión:
+	partPath := PartialFilePath(dir, hash)
+	activeUploadsMu.Lock()
+	busy := activeUploads[partPath]
+	activeUploads[partPath] = true
+	activeUploadsMu.Unlock()
+	if busy {
+		return Failure(MsgBusy, "el archivo ya se está recibiendo en otra conexión: "+fileName)
+	}
+	defer func() {
+		activeUploadsMu.Lock()
+		delete(activeUploads, partPath)
+		activeUploadsMu.Unlock()
+	}()
+
+	// Mientras se recibe el archivo, su reserva cubre los bytes del archivo parcial y se dejan de contar
+	// en el uso. Si la subida no termina, el archivo parcial se vuelve a contar en la categoría y en el
+	// cliente hasta que se reanude o caduque:
+	_, category, _ := GetFileType(fileName)
+	if info, err := os.Stat(partPath); err == nil {
+		Usage.Remove(partPath, category.Name, info.Size())
+	}
+	defer func() {
+		if info, err := os.Stat(partPath); err == nil {
+			Usage.Record(partPath, category.Name, client, info.Size(), 0)
+		}
+	}()
+
+	// Se reserva el espacio del archivo en las cuotas de su categoría y del cliente:
+	reservation, err := Usage.Reserve(category.Name, client, dataLen, ReplacedPath(dir, fileName, fileMsg.Collision))
+	if err != nil {
+		return UploadFailure(err)
+	}
+	defer Usage.Release(reservation)
+
+	// Se abre el archivo parcial y se indica al cliente desde qué byte debe continuar:
+	part, offset, hasher, err := OpenPartialFile(partPath, dataLen)
+	if err != nil {
+		return StorageFailure("abriendo el archivo parcial", err)
+	}
+	defer part.Close()
+
+	err = sendTCPOffset(conn, offset)
+	if err != nil {
+		response := Failure(MsgFailure, "al enviar la posición de inicio al cliente: "+err.Error())
+		response.Close = true
+		return response
+	}
+
+	// Se escriben los datos restantes en el archivo parcial mientras se calcula su hash. Si falla, no
+	// se sabe cuántos datos quedan en la conexión y se cierra:
+	_, err = io.CopyN(io.MultiWriter(part, hasher), throttle.Reader(conn), dataLen-offset)
+	if err != nil {
+		response := Failure(MsgFailure, "recibiendo los datos del archivo, se conserva el archivo parcial: "+err.Error())
+		response.Close = true
+		return response
+	}
+	err = SyncFile(part)
 	if err != nil {
-		fmt.Println("[ERROR]:", err)
-		return MsgFailure
+		os.Remove(partPath)
+		return StorageFailure("al escribir datos del archivo", err)
 	}
 
-	// Se crea un archivo para guardar el archivo recibido:
-	outPath := filepath.Join(dir, fileMsg.FileName)
-	// Se crea el archivo:
-	err = CreateFile(outPath, &fileMsg)
+	// Se verifica si el hash del archivo coincide con el enviado por el cliente; si no coincide, el
+	// archivo parcial no sirve para reanudar y se elimina:
+	var received [32]byte
+	copy(received[:], hasher.Sum(nil))
+	err = CompareHash256(received, hash)
 	if err != nil {
-		fmt.Println("[ERROR]:", err)
-		return MsgFailure
+		os.Remove(partPath)
+		response := Failure(MsgHashMismatch, err.Error())
+		response.Hash = received
+		return response
+	}
+
+	// Se verifica el contenido y se mueve el archivo parcial a su ruta final según la política de
+	// colisión; si se rechaza, el archivo completo no sirve para reanudar y se elimina:
+	outPath, err := SaveUpload(partPath, fileName, dataLen, fileMsg.Collision, client)
+	if err != nil {
+		var uploadErr *UploadError
+		if errors.As(err, &uploadErr) {
+			os.Remove(partPath)
+		}
+		return UploadFailure(err)
 	}
 
 	// Si se guardó correctamente el archivo, se imprime en la terminal de logs:
 	WriteLog(outPath)
 
-	return MsgSuccess
+	return Response{Status: MsgSuccess, Reason: "archivo guardado", Path: outPath, Hash: received}
 }
 
-// readMessage decodifica la estructura del mensaje desde la conexión TCP.
+// handleUsage responde con el uso de almacenamiento de cada categoría y del cliente, codificado en JSON.
+func handleUsage(client string) Response {
+	body, err := json.Marshal(Usage.Report(client))
+	if err != nil {
+		return Failure(MsgFailure, "al codificar el reporte de uso: "+err.Error())
+	}
+	return Response{Status: MsgSuccess, Reason: "uso de almacenamiento", Body: body}
+}
+
+// handleGet busca el archivo solicitado por categoría y nombre, y lo prepara para enviarlo después de
+// la respuesta junto con su hash SHA-256.
+func handleGet(conn net.Conn) Response {
+	categoryName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	fileName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	path, err := StoredFilePath(categoryName, fileName)
+	if err != nil {
+		return UploadFailure(err)
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Failure(MsgNotFound, "archivo no encontrado: "+categoryName+"/"+fileName)
+	}
+	if err != nil {
+		return StorageFailure("al abrir el archivo", err)
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return Failure(MsgNotFound, "archivo no encontrado: "+categoryName+"/"+fileName)
+	}
+
+	// Se calcula el hash del archivo abierto y se regresa al inicio para enviarlo; si el archivo se
+	// reemplaza mientras tanto, se sigue enviando el que se abrió:
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return StorageFailure("al leer el archivo", err)
+	}
+	var hash [32]byte
+	copy(hash[:], hasher.Sum(nil))
+
+	return Response{Status: MsgSuccess, Reason: "archivo encontrado", Path: path, Hash: hash, File: file, Size: info.Size()}
+}
+
+// handleList responde con una página de los archivos guardados, codificada en JSON. El mensaje contiene
+// la categoría (vacía para todas), el patrón glob que deben cumplir los nombres (vacío para todos), la
+// posición del primer archivo (4 bytes) y la cantidad de archivos por página (4 bytes).
+func handleList(conn net.Conn) Response {
+	categoryName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	pattern, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	pageBuf := make([]byte, 8)
+	_, err = io.ReadFull(conn, pageBuf)
+	if err != nil {
+		return badRequest(err)
+	}
+	offset := int(binary.BigEndian.Uint32(pageBuf[0:4]))
+	limit := int(binary.BigEndian.Uint32(pageBuf[4:8]))
+
+	list, err := ListFiles(categoryName, pattern, offset, limit)
+	if err != nil {
+		return OperationFailure("al listar los archivos", err)
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		return Failure(MsgFailure, "al codificar el listado: "+err.Error())
+	}
+	return Response{Status: MsgSuccess, Reason: "listado de archivos", Body: body}
+}
+
+// handleDelete elimina el archivo indicado por categoría y nombre.
+func handleDelete(conn net.Conn, client string) Response {
+	categoryName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	fileName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	path, err := DeleteFile(categoryName, fileName)
+	if err != nil {
+		return OperationFailure("al eliminar el archivo", err)
+	}
+	LogEvent("Archivo eliminado"+byClient(client)+":", path)
+	return Response{Status: MsgSuccess, Reason: "archivo eliminado", Path: path}
+}
+
+// handleRename cambia el nombre del archivo indicado por categoría y nombre al nombre nuevo que sigue
+// en el mensaje.
+func handleRename(conn net.Conn, client string) Response {
+	categoryName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	oldName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+	newName, err := readString16(conn, MaxPathLen)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	oldPath, newPath, err := RenameFile(categoryName, oldName, newName)
+	if err != nil {
+		return OperationFailure("al renombrar el archivo", err)
+	}
+	LogEvent("Archivo renombrado"+byClient(client)+":", oldPath+" -> "+newPath)
+	return Response{Status: MsgSuccess, Reason: "archivo renombrado", Path: newPath}
+}
+
+// byClient devuelve el sufijo que identifica al cliente en los logs, o una cadena vacía si no hay
+// autenticación.
+func byClient(client string) string {
+	if client == "" {
+		return ""
+	}
+	return " por " + client
+}
+
+// readString16 lee una cadena precedida por su longitud en 2 bytes, que no puede superar max.
+func readString16(conn net.Conn, max int) (string, error) {
+	lenBuf := make([]byte, 2)
+	_, err := io.ReadFull(conn, lenBuf)
+	if err != nil {
+		return "", err
+	}
+	n := int(binary.BigEndian.Uint16(lenBuf))
+	if n > max {
+		return "", fmt.Errorf("el campo supera %d bytes", max)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readRequestHeader decodifica el encabezado común de los mensajes TCP: la versión del protocolo, la
+// operación solicitada y la credencial del cliente.
+func readRequestHeader(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header) // Versión del protocolo, indica el inicio del mensaje, y operación
+	if err != nil {
+		return 0, "", err
+	}
+	if header[0] != ProtocolVersion {
+		return 0, "", fmt.Errorf("versión de protocolo no soportada: %d", header[0])
+	}
+
+	// Se lee la credencial del cliente:
+	tokenLenBuf := make([]byte, 2)
+	_, err = io.ReadFull(conn, tokenLenBuf)
+	if err != nil {
+		return 0, "", err
+	}
+	tokenLen := int(binary.BigEndian.Uint16(tokenLenBuf))
+	if tokenLen > MaxTokenLen {
+		return 0, "", fmt.Errorf("la credencial supera %d bytes", MaxTokenLen)
+	}
+	tokenBuf := make([]byte, tokenLen)
+	_, err = io.ReadFull(conn, tokenBuf)
+	if err != nil {
+		return 0, "", err
+	}
+	return header[1], string(tokenBuf), nil
+}
+
+// readMessage decodifica el encabezado de una subida desde la conexión TCP: la política de colisión, las
+// opciones de la subida y el nombre, la longitud de los datos y el hash del archivo. Los datos se leen
+// después por separado.
 func readMessage(conn net.Conn, msg *FileMessage) error {
-	// Se decodifica la estructura del mensaje desde la conexión:
-	_, err := io.ReadFull(conn, []byte{0}) // Indicador de inicio del mensaje
+	// Se lee la política de colisión solicitada:
+	collision := make([]byte, 1)
+	_, err := io.ReadFull(conn, collision)
 	if err != nil {
 		return err
 	}
+	if collision[0] > CollisionVersion {
+		return fmt.Errorf("política de colisión no válida: %d", collision[0])
+	}
+	msg.Collision = collision[0]
+
+	// Se leen las opciones de la subida:
+	flags := make([]byte, 1)
+	_, err = io.ReadFull(conn, flags)
+	if err != nil {
+		return err
+	}
+	if flags[0]&^UploadKeepPath != 0 {
+		return fmt.Errorf("opciones de subida no válidas: %d", flags[0])
+	}
+	msg.Flags = flags[0]
 
 	// Se lee el nombre del archivo:
 	fileNameLenBuf := make([]byte, 4)
 	_, err = io.ReadFull(conn, fileNameLenBuf)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	fileNameLen := int(binary.BigEndian.Uint32(fileNameLenBuf))
+	fileNameLen := binary.BigEndian.Uint32(fileNameLenBuf)
+	if fileNameLen > MaxPathLen {
+		return fmt.Errorf("el nombre del archivo supera %d bytes", MaxPathLen)
+	}
 
 	fileNameBuf := make([]byte, fileNameLen)
 	_, err = io.ReadFull(conn, fileNameBuf)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	msg.FileName = string(fileNameBuf)
 
-	// Se leen los datos del archivo:
-	dataLenBuf := make([]byte, 4)
+	// Se lee la longitud de los datos del archivo:
+	dataLenBuf := make([]byte, 8)
 	_, err = io.ReadFull(conn, dataLenBuf)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	dataLen := int(binary.BigEndian.Uint32(dataLenBuf))
-
-	msg.Data = make([]byte, dataLen)
-	_, err = io.ReadFull(conn, msg.Data)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	dataLen := binary.BigEndian.Uint64(dataLenBuf)
+	if dataLen > math.MaxInt64 {
+		return fmt.Errorf("longitud de datos no válida: %d", dataLen)
 	}
+	msg.DataLen = int64(dataLen)
 
 	// Se lee el hash del archivo:
 	_, err = io.ReadFull(conn, msg.Hash[:])
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
 	return nil
 }
 
-// sendTCPResponse envía un mensaje de éxito (1) o error (0) al cliente UDP.
-func sendTCPResponse(conn net.Conn, status byte) error {
-	_, err := conn.Write([]byte{status})
+// sendTCPOffset acepta la subida e indica al cliente cuántos bytes del archivo ya tiene el servidor. Si
+// la subida se rechaza, en su lugar se envía la respuesta completa con el código de error.
+func sendTCPOffset(conn net.Conn, offset int64) error {
+	reply := make([]byte, 9)
+	reply[0] = MsgSuccess
+	binary.BigEndian.PutUint64(reply[1:], uint64(offset))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// sendTCPResponse envía la respuesta con el estado de la operación al cliente TCP. Si la respuesta
+// incluye un archivo, después se envían su tamaño (8 bytes) y su contenido, a la tasa que permite
+// response.Throttle.
+func sendTCPResponse(conn net.Conn, response Response) error {
+	_, err := conn.Write(response.Encode())
+	if err != nil {
+		return err
+	}
+	if response.File == nil {
+		return nil
+	}
+
+	sizeBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(sizeBuf, uint64(response.Size))
+	_, err = conn.Write(sizeBuf)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(response.Throttle.Writer(conn), response.File, response.Size)
 	if err != nil {
 		return err
 	}
+	LogEvent("Archivo descargado:", response.Path)
 	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// uploadTCP envía data con el nombre fileName a handleUpload por una conexión en memoria, como lo hace el
+// cliente, y devuelve la respuesta del servidor.
+func uploadTCP(t *testing.T, fileName string, data []byte, policy byte) Response {
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan Response, 1)
+	go func() {
+		response := handleUpload(server, "", nil)
+		server.Close()
+		done <- response
+	}()
+
+	header := []byte{policy, 0}
+	header = binary.BigEndian.AppendUint32(header, uint32(len(fileName)))
+	header = append(header, fileName...)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	hash := sha256.Sum256(data)
+	header = append(header, hash[:]...)
+	_, err := client.Write(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// El servidor acepta la subida e indica desde qué byte continuar:
+	reply := make([]byte, 9)
+	_, err = io.ReadFull(client, reply)
+	if err != nil {
+		t.Fatalf("el servidor rechazó la subida: %v", (<-done).Reason)
+	}
+	offset := binary.BigEndian.Uint64(reply[1:])
+	_, err = client.Write(data[offset:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-done
+}
+
+func TestHandleUploadWriteFailures(t *testing.T) {
+	tests := []struct {
+		writeFailure
+		keepsPartial bool // Se conserva el archivo parcial completo para que el reintento no reenvíe los datos
+	}{
+		{writeFailure{"sincronizar el archivo", CollisionOverwrite, func(t *testing.T) { injectSyncFailure(t, false) }}, false},
+		{storeFailures[0], true},
+		{storeFailures[1], true},
+		{storeFailures[2], true},
+		{storeFailures[3], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupStorage(t)
+			data := []byte("hola\n")
+			tt.inject(t)
+
+			response := uploadTCP(t, "a.txt", data, tt.policy)
+			if response.Status != MsgStorageError {
+				t.Errorf("el estado de la respuesta es %d, se esperaba %d", response.Status, MsgStorageError)
+			}
+			assertNotExist(t, filepath.Join(dir, "a.txt"), "el archivo final")
+			partPath := PartialFilePath(dir, sha256.Sum256(data))
+			if !tt.keepsPartial {
+				assertNotExist(t, partPath, "el archivo parcial")
+			}
+		})
+	}
+}
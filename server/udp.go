@@ -1,143 +1,544 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"io"
+	"math"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
+	"time"
 )
 
-var chunkSize int = GlobalConfig.ChunkSize // Tamaño de los trozos de datos, normal 1024, 8192
+// Tipos de paquete del protocolo UDP confiable:
+const (
+	PacketInit   = 1 // Inicio de una transferencia (cliente → servidor)
+	PacketData   = 2 // Fragmento de datos del archivo (cliente → servidor)
+	PacketAck    = 3 // Confirmación selectiva de fragmentos (servidor → cliente)
+	PacketResult = 4 // Estado final de la transferencia (servidor → cliente)
+)
+
+const (
+	maxDatagramSize = 65507 // Tamaño máximo de la carga útil de un datagrama UDP
+	packetHeaderLen = 5     // Tipo de paquete (1) + ID de transferencia (4)
+	maxAckBitmapLen = 256   // Bytes máximos del mapa de bits de una confirmación selectiva
+
+	// Fragmentos a partir de base que el servidor acepta: los que cubre una confirmación, igual que la
+	// ventana máxima del cliente.
+	udpReceiveWindow = maxAckBitmapLen * 8
+)
+
+// udpTransfer contiene el estado de reensamblado de una transferencia UDP. Los fragmentos se
+// escriben en su posición dentro de un archivo temporal, por lo que pueden llegar en cualquier orden.
+type udpTransfer struct {
+	fileName  string        // Nombre del archivo
+	collision byte          // Política de colisión solicitada por el cliente
+	client    string        // Nombre del cliente autenticado
+	reserved  *Reservation  // Espacio reservado en las cuotas, se libera al terminar
+	throttle  *Throttle     // Limita la tasa de recepción de los fragmentos, se libera al terminar
+	hash      [32]byte      // Hash del archivo enviado por el cliente
+	totalSize int64         // Tamaño total del archivo
+	chunkSize int           // Tamaño de cada fragmento
+	dir       string        // Directorio donde se guardará el archivo
+	file      *os.File      // Archivo temporal donde se reconstruyen los datos
+	received  receiveWindow // Fragmentos recibidos a partir del primero que falta
+	numChunks int           // Cantidad de fragmentos del archivo
+	done      bool          // Indica si la transferencia ya terminó
+	response  Response      // Respuesta final de la transferencia
+}
+
+// receiveWindow registra los fragmentos recibidos a partir de base, el primero que aún no se ha recibido,
+// en un mapa de bits circular de udpReceiveWindow fragmentos. Así la memoria de una transferencia no
+// depende del tamaño que declara el cliente.
+type receiveWindow struct {
+	base int                           // Primer fragmento que aún no se ha recibido
+	bits [udpReceiveWindow / 64]uint64 // Bit seq % udpReceiveWindow de cada fragmento de la ventana
+}
+
+// inWindow indica si el fragmento seq cabe en la ventana.
+func (w *receiveWindow) inWindow(seq int) bool {
+	return seq >= w.base && seq < w.base+udpReceiveWindow
+}
 
-// HandleUDP envuelve a handleUDPClient para manejar la recepción de archivos a través de una conexión UDP.
-func HandleUDP(conn *net.UDPConn) {
-	status, clientAddr := handleUDPClient(conn)
-	// Se envía el estado de error de la operación al cliente:
-	if clientAddr != nil && !sendUDPResponse(conn, clientAddr, status) {
-		fmt.Println("[ERROR] al enviar respuesta del estado de la operación al cliente.")
+// has indica si se recibió el fragmento seq. Los anteriores a base ya se recibieron y los que están
+// fuera de la ventana todavía no.
+func (w *receiveWindow) has(seq int) bool {
+	if seq < w.base {
+		return true
 	}
+	if !w.inWindow(seq) {
+		return false
+	}
+	i := seq % udpReceiveWindow
+	return w.bits[i/64]&(1<<(i%64)) != 0
 }
 
-// handleUDPClient maneja la recepción de archivos a través de una conexión UDP.
-func handleUDPClient(conn *net.UDPConn) (byte, *net.UDPAddr) {
-	// Se recibe la estructura del mensaje que contiene el nombre, los datos y el hash del archivo:
-	var fileMsg FileMessage
-	_, clientAddr, err := readUDPMessage(conn, &fileMsg)
+// set marca como recibido el fragmento seq, que debe caber en la ventana, y la desliza hasta el
+// siguiente fragmento que falta.
+func (w *receiveWindow) set(seq int) {
+	i := seq % udpReceiveWindow
+	w.bits[i/64] |= 1 << (i % 64)
+	for w.has(w.base) {
+		i = w.base % udpReceiveWindow
+		w.bits[i/64] &^= 1 << (i % 64)
+		w.base++
+	}
+}
+
+// udpSessionKey identifica una sesión UDP por la dirección del cliente y el ID de transferencia.
+type udpSessionKey struct {
+	addr       string
+	transferID uint32
+}
+
+// udpSession contiene una transferencia UDP y la cola de datagramas que le pertenecen. Cada sesión
+// se procesa en su propia goroutine, por lo que su estado no necesita sincronización.
+type udpSession struct {
+	key        udpSessionKey
+	conn       *net.UDPConn
+	clientAddr *net.UDPAddr
+	packets    chan []byte  // Datagramas pendientes de procesar
+	transfer   *udpTransfer // Transferencia en curso, nil hasta recibir el paquete de inicio
+	serverPub  []byte       // Llave pública efímera del servidor, si la sesión está cifrada
+	cipher     *udpCipher   // Cifrador de la sesión, nil si la sesión no está cifrada
+	counted    bool         // Indica si la sesión ocupa un lugar en udpSessionsByHost
+}
+
+const (
+	udpSessionQueueLen    = 256              // Datagramas en cola por sesión antes de descartarlos
+	udpSessionIdle        = 30 * time.Second // Inactividad tras la cual se descarta una sesión
+	udpMaxSessionsPerHost = 64               // Transferencias simultáneas que puede tener una misma dirección IP
+)
+
+// udpSessions contiene las sesiones UDP activas y la cantidad de sesiones de cada dirección IP cuya
+// transferencia sigue en curso.
+var (
+	udpSessions       = make(map[udpSessionKey]*udpSession)
+	udpSessionsByHost = make(map[string]int)
+	udpSessionsMu     sync.Mutex
+)
+
+// HandleUDP lee un datagrama de la conexión UDP en buf, que se reutiliza entre llamadas, y lo encola en
+// la sesión a la que pertenece, creando una sesión nueva cuando recibe un paquete de inicio o de
+// intercambio de llaves.
+func HandleUDP(conn *net.UDPConn, buf []byte) {
+	n, clientAddr, err := conn.ReadFromUDP(buf)
 	if err != nil {
-		fmt.Println("[ERROR] leyendo el mensaje:", err)
-		return MsgFailure, clientAddr
+		fmt.Println("[ERROR] leyendo el datagrama:", err)
+		return
+	}
+	if n < packetHeaderLen {
+		fmt.Println("[ERROR] datagrama incompleto recibido de", clientAddr)
+		return
 	}
 
-	// Se crea un directorio para guardar el archivo basado en su tipo (imagen, audio, vídeo o texto):
-	fileType, filePath, valid := GetFileType(fileMsg.FileName)
-	if !valid {
-		fmt.Println("[ERROR] extensión de archivo no válida.")
-		return MsgFailure, clientAddr
+	// Se copia el datagrama con su tamaño exacto, ya que buf se reutiliza para el siguiente:
+	packet := make([]byte, n)
+	copy(packet, buf[:n])
+	key := udpSessionKey{
+		addr:       clientAddr.String(),
+		transferID: binary.BigEndian.Uint32(packet[1:packetHeaderLen]),
 	}
-	dir := filepath.Join(filePath, fileType)
-	err = os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		fmt.Println("[ERROR] creando directorio:", err)
-		return MsgFailure, clientAddr
+
+	udpSessionsMu.Lock()
+	session, ok := udpSessions[key]
+	if !ok {
+		// Solo un paquete de inicio o de intercambio de llaves puede abrir una sesión nueva:
+		if packet[0] != PacketInit && packet[0] != PacketHello {
+			udpSessionsMu.Unlock()
+			return
+		}
+		// Se limita la cantidad de transferencias en curso de cada dirección IP, que con IDs de
+		// transferencia distintos podría abrir sesiones sin límite. El cliente recibe MsgBusy para que
+		// no espere una respuesta:
+		host := clientAddr.IP.String()
+		if udpSessionsByHost[host] >= udpMaxSessionsPerHost {
+			udpSessionsMu.Unlock()
+			busy := &udpSession{key: key, conn: conn, clientAddr: clientAddr}
+			busy.sendResponse(Failure(MsgBusy, fmt.Sprintf("demasiadas transferencias UDP en curso desde %s", host)))
+			return
+		}
+		udpSessionsByHost[host]++
+		session = &udpSession{
+			key:        key,
+			conn:       conn,
+			clientAddr: clientAddr,
+			packets:    make(chan []byte, udpSessionQueueLen),
+			counted:    true,
+		}
+		udpSessions[key] = session
+		go session.run()
 	}
+	udpSessionsMu.Unlock()
 
-	// Se verifica si el hash del archivo coincide con el enviado por el cliente:
-	err = CompareHash256(sha256.Sum256(fileMsg.Data), fileMsg.Hash)
-	if err != nil {
-		fmt.Println(err)
-		return MsgFailure, clientAddr
+	// Si la cola de la sesión está llena se descarta el datagrama; el cliente lo retransmitirá:
+	select {
+	case session.packets <- packet:
+	default:
 	}
+}
 
-	// Se crea un archivo para guardar el archivo recibido:
-	outPath := filepath.Join(dir, fileMsg.FileName)
-	// Se crea el archivo:
-	err = CreateFile(outPath, &fileMsg)
-	if err != nil {
-		fmt.Println(err)
-		return MsgFailure, clientAddr
+// releaseHost libera el lugar que ocupa la sesión entre las transferencias en curso de su dirección IP.
+// La sesión se conserva hasta quedar inactiva para reenviar la respuesta final si el cliente no la
+// recibió, pero ya no cuenta para el límite de udpMaxSessionsPerHost.
+func (s *udpSession) releaseHost() {
+	udpSessionsMu.Lock()
+	defer udpSessionsMu.Unlock()
+	if !s.counted {
+		return
+	}
+	s.counted = false
+	host := s.clientAddr.IP.String()
+	udpSessionsByHost[host]--
+	if udpSessionsByHost[host] == 0 {
+		delete(udpSessionsByHost, host)
 	}
+}
 
-	// Si se guardó correctamente el archivo, se imprime en la terminal de logs:
-	WriteLog(outPath)
+// run procesa los datagramas de la sesión hasta que permanece inactiva durante udpSessionIdle.
+func (s *udpSession) run() {
+	idle := time.NewTimer(udpSessionIdle)
+	defer idle.Stop()
 
-	return MsgSuccess, clientAddr
+	for {
+		select {
+		case packet := <-s.packets:
+			s.handlePacket(packet)
+			if s.transfer != nil && s.transfer.done {
+				s.releaseHost()
+			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(udpSessionIdle)
+		case <-idle.C:
+			udpSessionsMu.Lock()
+			delete(udpSessions, s.key)
+			udpSessionsMu.Unlock()
+			s.releaseHost()
+			if s.transfer != nil && !s.transfer.done {
+				s.transfer.finish(Failure(MsgFailure, "transferencia UDP abandonada por inactividad: "+s.transfer.fileName))
+			}
+			return
+		}
+	}
 }
 
-// readUDPMessage decodifica la estructura del mensaje desde la conexión UDP, que puede contener fragmentos.
-func readUDPMessage(conn *net.UDPConn, msg *FileMessage) (int, *net.UDPAddr, error) {
-	// Decodificar la estructura del mensaje desde la conexión
-	_, addr, err := conn.ReadFromUDP([]byte{0}) // Indicador de inicio del mensaje
-	if err != nil {
-		return 0, nil, err
+// handlePacket procesa un datagrama de la sesión según su tipo de paquete. En una sesión cifrada solo
+// se aceptan paquetes sellados con la llave de la sesión; los demás se descartan.
+func (s *udpSession) handlePacket(packet []byte) {
+	switch packet[0] {
+	case PacketHello:
+		s.handleHello(packet[packetHeaderLen:])
+		return
+	case PacketSealed:
+		if s.cipher == nil {
+			return
+		}
+		var err error
+		packet, err = s.cipher.open(packet, directionClient)
+		if err != nil {
+			fmt.Println("[ERROR] descartando paquete de", s.clientAddr.String()+":", err)
+			return
+		}
+	default:
+		if s.cipher != nil {
+			return
+		}
+		// Si el servidor exige cifrado, se rechaza la transferencia sin cifrar:
+		if GlobalConfig.UdpEncryption && packet[0] == PacketInit {
+			s.sendResponse(Failure(MsgBadRequest, "el servidor exige transferencias UDP cifradas"))
+			return
+		}
 	}
 
-	// Se lee el nombre del archivo:
-	fileNameLenBuf := make([]byte, 4)
-	_, err = io.ReadFull(conn, fileNameLenBuf)
-	if err != nil {
-		return 0, nil, err
+	switch packet[0] {
+	case PacketInit:
+		s.handleInit(packet[packetHeaderLen:])
+	case PacketData:
+		s.handleData(packet[packetHeaderLen:])
+	default:
+		fmt.Println("[ERROR] tipo de paquete UDP desconocido:", packet[0])
 	}
-	fileNameLen := int(binary.BigEndian.Uint32(fileNameLenBuf))
+}
 
-	fileNameBuf := make([]byte, fileNameLen)
-	_, err = io.ReadFull(conn, fileNameBuf)
-	if err != nil {
-		return 0, nil, err
+// handleHello procesa el intercambio de llaves que inicia una sesión cifrada y responde con la llave
+// pública efímera del servidor.
+func (s *udpSession) handleHello(payload []byte) {
+	// Si el intercambio ya se hizo, el cliente no recibió la respuesta anterior y se reenvía:
+	if s.cipher == nil {
+		if s.transfer != nil || len(payload) < publicKeyLen {
+			return
+		}
+		serverPub, c, err := newServerHandshake(s.key.transferID, payload[:publicKeyLen], GlobalConfig.UdpPSK)
+		if err != nil {
+			fmt.Println("[ERROR] en el intercambio de llaves con", s.clientAddr.String()+":", err)
+			return
+		}
+		s.serverPub = serverPub
+		s.cipher = c
 	}
-	msg.FileName = string(fileNameBuf)
 
-	// Se lee el tamaño total del archivo:
-	totalSizeBuf := make([]byte, 4)
-	_, err = io.ReadFull(conn, totalSizeBuf)
+	packet := make([]byte, packetHeaderLen+publicKeyLen)
+	packet[0] = PacketHelloReply
+	binary.BigEndian.PutUint32(packet[1:5], s.key.transferID)
+	copy(packet[packetHeaderLen:], s.serverPub)
+	_, err := s.conn.WriteToUDP(packet, s.clientAddr)
 	if err != nil {
-		return 0, nil, err
+		fmt.Println("[ERROR] enviando llave pública al cliente UDP: ", err)
 	}
-	totalSize := int(binary.BigEndian.Uint32(totalSizeBuf))
+}
 
-	// Se reciben los fragmentos y se reconstruye el archivo:
-	var receivedData []byte // Almacena los datos recibidos
-	receivedDataSize := 0   // Variable para rastrear la cantidad total de bytes leídos
+// handleInit procesa el paquete de inicio de una transferencia, que contiene la versión del protocolo,
+// el tamaño de los fragmentos, el tamaño total, el hash, la política de colisión, la credencial del
+// cliente y el nombre del archivo.
+func (s *udpSession) handleInit(payload []byte) {
+	// Si la transferencia ya existe, el cliente no recibió la respuesta anterior y se reenvía:
+	if s.transfer != nil {
+		s.reply()
+		return
+	}
 
-	for receivedDataSize < totalSize {
-		remainingSize := totalSize - receivedDataSize
-		readSize := chunkSize
-		if remainingSize < chunkSize {
-			readSize = remainingSize
+	if len(payload) < 1+4+8+32+1+2+2 {
+		fmt.Println("[ERROR] paquete de inicio incompleto.")
+		return
+	}
+	version := payload[0]
+	chunkSize := int(binary.BigEndian.Uint32(payload[1:5]))
+	totalSize := binary.BigEndian.Uint64(payload[5:13])
+	t := &udpTransfer{chunkSize: chunkSize, collision: payload[45]}
+	copy(t.hash[:], payload[13:45])
+	tokenLen := int(binary.BigEndian.Uint16(payload[46:48]))
+	fileNameLen := int(binary.BigEndian.Uint16(payload[48:50]))
+	if len(payload) < 50+tokenLen+fileNameLen {
+		fmt.Println("[ERROR] paquete de inicio incompleto.")
+		return
+	}
+	token := string(payload[50 : 50+tokenLen])
+	fileName, nameErr := SanitizeFileName(string(payload[50+tokenLen : 50+tokenLen+fileNameLen]))
+	t.fileName = fileName
+	s.transfer = t
+
+	// Se valida la transferencia antes de recibir los datos:
+	client, authorized := Authenticate(token)
+	t.client = client
+	dir, dirErr := UploadDir(t.fileName, int64(totalSize))
+	switch {
+	case version != ProtocolVersion:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("versión de protocolo no soportada: %d", version)))
+	case tokenLen > MaxTokenLen:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("la credencial supera %d bytes", MaxTokenLen)))
+	case !authorized:
+		t.finish(Failure(MsgUnauthorized, "credencial no válida de "+s.clientAddr.String()))
+	case fileNameLen > MaxPathLen:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("el nombre del archivo supera %d bytes", MaxPathLen)))
+	case nameErr != nil:
+		t.finish(Failure(MsgBadRequest, nameErr.Error()))
+	case t.collision > CollisionVersion:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("política de colisión no válida: %d", t.collision)))
+	case chunkSize <= 0 || chunkSize > GlobalConfig.ChunkSize:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("tamaño de fragmento no válido: %d", chunkSize)))
+	case totalSize > math.MaxInt64 || (totalSize+uint64(chunkSize)-1)/uint64(chunkSize) > math.MaxUint32:
+		t.finish(Failure(MsgBadRequest, fmt.Sprintf("tamaño de archivo no válido: %d", totalSize)))
+	case dirErr != nil:
+		t.finish(UploadFailure(dirErr))
+	case RejectsExisting(dir, t.fileName, t.collision):
+		t.finish(Failure(MsgExists, "el archivo ya existe: "+t.fileName))
+	default:
+		t.totalSize = int64(totalSize)
+
+		// Se reserva el espacio del archivo en las cuotas de su categoría y del cliente antes de
+		// reservar cualquier otro recurso:
+		_, category, _ := GetFileType(t.fileName)
+		reservation, err := Usage.Reserve(category.Name, client, t.totalSize, ReplacedPath(dir, t.fileName, t.collision))
+		if err != nil {
+			t.finish(UploadFailure(err))
+			break
 		}
+		t.reserved = &reservation
+		t.numChunks = int((t.totalSize + int64(chunkSize) - 1) / int64(chunkSize))
+		t.throttle = AcquireThrottle(client, s.clientAddr)
 
-		// Se leen los datos del fragmento del archivo:
-		dataBuf := make([]byte, readSize)
-		_, err := io.ReadFull(conn, dataBuf)
+		// Se crea un directorio para guardar el archivo basado en su tipo (imagen, audio, vídeo o texto)
+		// y un archivo temporal donde se reconstruyen los fragmentos:
+		t.dir = dir
+		err = os.MkdirAll(t.dir, os.ModePerm)
 		if err != nil {
-			return receivedDataSize, nil, err
+			t.finish(StorageFailure("creando directorio", err))
+			break
+		}
+		t.file, err = NewTempFile(t.dir)
+		if err != nil {
+			t.finish(StorageFailure("creando el archivo temporal", err))
+			break
+		}
+		if t.numChunks == 0 {
+			t.finish(t.store())
 		}
+	}
+
+	s.reply()
+}
 
-		// Se agregan los datos del fragmento al archivo reconstruido:
-		receivedData = append(receivedData, dataBuf...)
-		receivedDataSize += len(dataBuf)
+// handleData procesa un fragmento de datos y lo escribe en su posición dentro del archivo.
+func (s *udpSession) handleData(payload []byte) {
+	t := s.transfer
+	if t == nil {
+		// Fragmento recibido antes que el paquete de inicio:
+		return
+	}
+	if t.done || len(payload) < 4 {
+		s.reply()
+		return
+	}
+
+	// Se verifica que el fragmento tenga un número de secuencia y un tamaño válidos. Los fragmentos que
+	// están más allá de la ventana se descartan; el cliente no los envía hasta recibir los anteriores:
+	seq := int(binary.BigEndian.Uint32(payload[0:4]))
+	chunk := payload[4:]
+	if seq >= t.numChunks || seq >= t.received.base+udpReceiveWindow {
+		return
+	}
+	offset := int64(seq) * int64(t.chunkSize)
+	end := offset + int64(t.chunkSize)
+	if end > t.totalSize {
+		end = t.totalSize
 	}
+	if int64(len(chunk)) != end-offset {
+		return
+	}
+
+	// Se guarda el fragmento si no se había recibido antes (los duplicados solo se confirman). Si hay un
+	// límite de tasa, la confirmación se retrasa hasta que el límite lo permite; mientras tanto la cola
+	// de la sesión se llena y el cliente, sin confirmaciones, deja de enviar fragmentos nuevos:
+	if !t.received.has(seq) {
+		t.throttle.Wait(len(chunk))
+		_, err := t.file.WriteAt(chunk, offset)
+		if err != nil {
+			t.finish(StorageFailure("al escribir datos del archivo", err))
+			s.reply()
+			return
+		}
+		t.received.set(seq)
+	}
+
+	// Cuando se reciben todos los fragmentos se verifica y se guarda el archivo:
+	if t.received.base == t.numChunks {
+		t.finish(t.store())
+	}
+
+	s.reply()
+}
+
+// finish marca la transferencia como terminada, libera el espacio reservado y elimina el archivo
+// temporal si no se guardó.
+func (t *udpTransfer) finish(response Response) {
+	t.done = true
+	t.response = response
+	t.throttle.Release()
+	t.throttle = nil
+	if t.reserved != nil {
+		Usage.Release(*t.reserved)
+		t.reserved = nil
+	}
+	if t.file != nil {
+		t.file.Close()
+		os.Remove(t.file.Name()) // No tiene efecto si el archivo ya se renombró
+		t.file = nil
+	}
+}
 
-	// Se lee el hash del archivo:
-	_, err = io.ReadFull(conn, msg.Hash[:])
+// store verifica el hash del archivo reconstruido y lo mueve a su ruta final.
+func (t *udpTransfer) store() Response {
+	err := SyncFile(t.file)
 	if err != nil {
-		return receivedDataSize, nil, err
+		return StorageFailure("al escribir datos del archivo", err)
 	}
 
-	// Se asignan los datos reconstruidos al mensaje:
-	msg.Data = receivedData
+	// Se verifica si el hash del archivo coincide con el enviado por el cliente:
+	hash, err := HashFile(t.file.Name())
+	if err != nil {
+		return StorageFailure("al leer el archivo recibido", err)
+	}
+	err = CompareHash256(hash, t.hash)
+	if err != nil {
+		response := Failure(MsgHashMismatch, err.Error())
+		response.Hash = hash
+		return response
+	}
+
+	// Se verifica el contenido y se mueve el archivo temporal a su ruta final según la política de colisión:
+	outPath, err := SaveUpload(t.file.Name(), t.fileName, t.totalSize, t.collision, t.client)
+	if err != nil {
+		return UploadFailure(err)
+	}
+
+	// Si se guardó correctamente el archivo, se imprime en la terminal de logs:
+	WriteLog(outPath)
+
+	return Response{Status: MsgSuccess, Reason: "archivo guardado", Path: outPath, Hash: hash}
+}
 
-	return receivedDataSize, addr, nil
+// reply envía al cliente el estado final de la transferencia si ya terminó o, en caso
+// contrario, una confirmación selectiva de los fragmentos recibidos.
+func (s *udpSession) reply() {
+	if s.transfer.done {
+		if !s.sendResponse(s.transfer.response) {
+			fmt.Println("[ERROR] al enviar respuesta del estado de la operación al cliente.")
+		}
+		return
+	}
+	s.sendAck()
 }
 
-// sendUDPResponse envía un mensaje de éxito (1) o error (0) al cliente UDP.
-func sendUDPResponse(conn *net.UDPConn, clientAddr *net.UDPAddr, status byte) bool {
-	_, err := conn.WriteToUDP([]byte{status}, clientAddr)
+// sendAck envía una confirmación selectiva: el primer fragmento no recibido y un mapa de bits
+// donde el bit i indica si se recibió el fragmento base+1+i.
+func (s *udpSession) sendAck() {
+	t := s.transfer
+	base := t.received.base
+	bitmapLen := min((t.numChunks-base+6)/8, maxAckBitmapLen)
+
+	packet := make([]byte, packetHeaderLen+4+2+bitmapLen)
+	packet[0] = PacketAck
+	binary.BigEndian.PutUint32(packet[1:5], s.key.transferID)
+	binary.BigEndian.PutUint32(packet[5:9], uint32(base))
+	binary.BigEndian.PutUint16(packet[9:11], uint16(bitmapLen))
+	bitmap := packet[11:]
+	for i := 0; i < bitmapLen*8; i++ {
+		seq := base + 1 + i
+		if seq < t.numChunks && t.received.has(seq) {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	err := s.write(packet)
+	if err != nil {
+		fmt.Println("[ERROR] enviando confirmación al cliente UDP: ", err)
+	}
+}
+
+// sendResponse envía la respuesta con el estado de la operación al cliente UDP.
+func (s *udpSession) sendResponse(response Response) bool {
+	packet := make([]byte, packetHeaderLen, packetHeaderLen+64)
+	packet[0] = PacketResult
+	binary.BigEndian.PutUint32(packet[1:5], s.key.transferID)
+	packet = append(packet, response.Encode()...)
+	err := s.write(packet)
 	if err != nil {
 		fmt.Println("[ERROR] enviando respuesta al cliente UDP: ", err)
 		return false
 	}
 	return true
 }
+
+// write envía un paquete al cliente, cifrado si la sesión está cifrada.
+func (s *udpSession) write(packet []byte) error {
+	if s.cipher != nil {
+		packet = s.cipher.seal(packet, directionServer)
+	}
+	_, err := s.conn.WriteToUDP(packet, s.clientAddr)
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+)
+
+func TestUDPStoreWriteFailures(t *testing.T) {
+	failures := append([]writeFailure{
+		{"sincronizar el archivo", CollisionOverwrite, func(t *testing.T) { injectSyncFailure(t, false) }},
+	}, storeFailures...)
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupStorage(t)
+			data := []byte("hola\n")
+			file, err := NewTempFile(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transfer := &udpTransfer{
+				fileName:  "a.txt",
+				collision: tt.policy,
+				hash:      sha256.Sum256(data),
+				totalSize: int64(len(data)),
+				dir:       dir,
+				file:      file,
+				numChunks: 1,
+			}
+			tmpPath := file.Name()
+			tt.inject(t)
+
+			transfer.finish(transfer.store())
+			if transfer.response.Status != MsgStorageError {
+				t.Errorf("el estado de la respuesta es %d, se esperaba %d", transfer.response.Status, MsgStorageError)
+			}
+			assertNotExist(t, tmpPath, "el archivo temporal")
+			assertNotExist(t, filepath.Join(dir, "a.txt"), "el archivo final")
+		})
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	var w receiveWindow
+	// Se reciben los fragmentos en desorden, incluido el último que cabe en la ventana:
+	for _, seq := range []int{1, udpReceiveWindow - 1, 2} {
+		w.set(seq)
+	}
+	if w.base != 0 || w.has(0) || !w.has(2) || !w.has(udpReceiveWindow-1) {
+		t.Fatalf("ventana inesperada antes de recibir el fragmento 0: base %d", w.base)
+	}
+	if w.inWindow(udpReceiveWindow) {
+		t.Fatalf("el fragmento %d no debería caber en la ventana", udpReceiveWindow)
+	}
+
+	// Al recibir el fragmento que falta, la ventana se desliza hasta el siguiente que falta y los bits de
+	// los fragmentos que quedan atrás se reutilizan:
+	w.set(0)
+	if w.base != 3 {
+		t.Fatalf("base = %d, se esperaba 3", w.base)
+	}
+	if w.has(udpReceiveWindow) || w.has(udpReceiveWindow+1) {
+		t.Fatal("los fragmentos nuevos de la ventana aparecen como recibidos")
+	}
+	if !w.has(1) || !w.has(udpReceiveWindow-1) {
+		t.Fatal("se perdió un fragmento recibido")
+	}
+	for seq := 3; seq < udpReceiveWindow+3; seq++ {
+		if seq != udpReceiveWindow-1 {
+			w.set(seq)
+		}
+	}
+	if w.base != udpReceiveWindow+3 {
+		t.Fatalf("base = %d, se esperaba %d", w.base, udpReceiveWindow+3)
+	}
+}
@@ -1,34 +1,169 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ProtocolVersion es la versión del protocolo de transferencia; es el primer byte de cada mensaje.
+const ProtocolVersion = 7
+
+// Códigos de estado que el servidor envía al cliente para indicar el resultado de una operación.
+const (
+	MsgSuccess         = 1  // 1 indica una operación exitosa
+	MsgFailure         = 0  // 0 indica una falla durante la operación sin una causa más específica
+	MsgUnauthorized    = 2  // 2 indica que la credencial del cliente no es válida
+	MsgBadRequest      = 3  // 3 indica un mensaje mal formado o una versión de protocolo no soportada
+	MsgInvalidType     = 4  // 4 indica que la extensión del archivo no está permitida
+	MsgHashMismatch    = 5  // 5 indica que el hash de los datos recibidos no coincide con el del cliente
+	MsgStorageError    = 6  // 6 indica que el servidor no pudo guardar el archivo (por ejemplo, disco lleno)
+	MsgBusy            = 7  // 7 indica que el archivo se está recibiendo en otra conexión
+	MsgExists          = 8  // 8 indica que el archivo ya existe y la política de colisión lo rechaza
+	MsgContentMismatch = 9  // 9 indica que el contenido del archivo no corresponde a su extensión
+	MsgTooLarge        = 10 // 10 indica que el archivo supera el tamaño máximo permitido
+	MsgQuotaExceeded   = 11 // 11 indica que el archivo superaría la cuota de su categoría o del cliente
+	MsgNotFound        = 12 // 12 indica que el archivo o la categoría solicitados no existen
+)
+
+// Operaciones que el cliente puede solicitar en una conexión TCP; es el segundo byte de cada mensaje.
+const (
+	OpUpload = 1 // Sube un archivo
+	OpUsage  = 2 // Consulta el uso de almacenamiento
+	OpGet    = 3 // Descarga un archivo guardado
+	OpList   = 4 // Lista los archivos guardados
+	OpDelete = 5 // Elimina un archivo guardado
+	OpRename = 6 // Cambia el nombre de un archivo guardado
 )
 
-// MsgSuccess y MsgFailure representan códigos de mensaje para indicar el estado de una operación.
+// Políticas de colisión que indican qué hacer cuando ya existe un archivo con el mismo nombre. El cliente
+// envía una en cada subida; CollisionDefault usa la política configurada en el servidor.
 const (
-	MsgSuccess = 1 // 1 indica una operación exitosa
-	MsgFailure = 0 // 0 indica una falla durante la operación
+	CollisionDefault   = 0 // Política configurada en el servidor
+	CollisionOverwrite = 1 // Reemplaza el archivo existente
+	CollisionReject    = 2 // Rechaza la subida con MsgExists
+	CollisionRename    = 3 // Guarda el archivo nuevo con un sufijo numérico: nombre_1.ext, nombre_2.ext, ...
+	CollisionVersion   = 4 // Conserva el archivo existente como versión: nombre.v1.ext, nombre.v2.ext, ...
 )
 
+// UploadKeepPath es la opción de subida que conserva los subdirectorios del nombre del archivo dentro del
+// directorio de su tipo, en lugar de guardar solo el último componente.
+const UploadKeepPath = 1
+
+// collisionPolicies asocia el nombre de cada política de colisión del archivo de configuración con su código.
+var collisionPolicies = map[string]byte{
+	"overwrite": CollisionOverwrite,
+	"reject":    CollisionReject,
+	"rename":    CollisionRename,
+	"version":   CollisionVersion,
+}
+
+// Response representa la respuesta del servidor al final de una operación.
+type Response struct {
+	Status   byte      // Código de estado de la operación
+	Reason   string    // Descripción legible del resultado
+	Path     string    // Ruta final del archivo guardado
+	Hash     [32]byte  // Hash SHA-256 calculado por el servidor
+	Body     []byte    // Datos adicionales de la operación, por ejemplo el reporte de uso en JSON
+	File     *os.File  // Archivo que se envía después de la respuesta, precedido por su tamaño (no se codifica)
+	Size     int64     // Tamaño de File
+	Throttle *Throttle // Limita la tasa de envío de File (no se codifica)
+	Close    bool      // Cierra la conexión después de la respuesta porque el mensaje no se leyó completo (no se codifica)
+}
+
+// ClientToken asocia un token de acceso con el nombre del cliente que lo usa.
+type ClientToken struct {
+	Name      string `json:"name"`      // Nombre del cliente
+	Token     string `json:"token"`     // Token que el cliente envía en cada mensaje
+	Quota     int64  `json:"quota"`     // Bytes que el cliente puede tener guardados; 0 indica que no hay límite
+	RateLimit int64  `json:"rateLimit"` // Bytes por segundo que el cliente puede transferir; 0 usa clientRateLimit
+}
+
+// Category describe un tipo de archivo que acepta el servidor y dónde se guarda.
+type Category struct {
+	Name       string   `json:"-"`          // Nombre de la categoría, la llave en el mapa de categorías
+	Path       string   `json:"path"`       // Ruta donde se guardan los archivos de la categoría
+	Extensions []string `json:"extensions"` // Extensiones de archivo que pertenecen a la categoría
+	MaxSize    int64    `json:"maxSize"`    // Tamaño máximo de un archivo en bytes; 0 indica que no hay límite
+	MimeTypes  []string `json:"mimeTypes"`  // Tipos MIME permitidos según el contenido; vacío permite cualquiera
+	Quota      int64    `json:"quota"`      // Bytes que puede ocupar la categoría; 0 indica que no hay límite
+}
+
 // ConnConfig contiene la configuración del servidor.
 type ConnConfig struct {
-	Host            string   `json:"ip"`              // Dirección IP del servidor
-	TcpPort         int      `json:"tcpPort"`         // Puerto TCP del servidor
-	UdpPort         int      `json:"udpPort"`         // Puerto UDP del servidor
-	ChunkSize       int      `json:"chunkSize"`       // Tamaño del fragmento para transferencias de archivos
-	ImagePath       string   `json:"imagePath"`       // Ruta para archivos de imágenes
-	AudioPath       string   `json:"audioPath"`       // Ruta para archivos de audio
-	VideoPath       string   `json:"videoPath"`       // Ruta para archivos de video
-	TextPath        string   `json:"textPath"`        // Ruta para archivos de texto
-	ImageExtensions []string `json:"imageExtensions"` // Extensiones de archivos de imágenes permitidas
-	AudioExtensions []string `json:"audioExtensions"` // Extensiones de archivos de audio permitidas
-	VideoExtensions []string `json:"videoExtensions"` // Extensiones de archivos de video permitidas
-	TextExtensions  []string `json:"textExtensions"`  // Extensiones de archivos de texto permitidas
+	Host            string        `json:"ip"`              // Dirección IP del servidor
+	TcpPort         int           `json:"tcpPort"`         // Puerto TCP del servidor
+	UdpPort         int           `json:"udpPort"`         // Puerto UDP del servidor
+	UdpEncryption   bool          `json:"udpEncryption"`   // Exige que las transferencias UDP estén cifradas
+	UdpPSK          string        `json:"udpPSK"`          // Llave precompartida que autentica las sesiones UDP cifradas; sin ella no se autentica el servidor
+	ChunkSize       int           `json:"chunkSize"`       // Tamaño del fragmento para transferencias de archivos
+	IdleTimeout     int           `json:"idleTimeout"`     // Segundos que una conexión TCP puede esperar la siguiente operación antes de cerrarse
+	TCPKeepAlive    int           `json:"tcpKeepAlive"`    // Segundos entre sondeos keep-alive de las conexiones TCP; negativo los deshabilita
+	PartialExpiry   int           `json:"partialExpiry"`   // Horas que se conserva el archivo parcial de una subida interrumpida; negativo lo conserva siempre
+	MaxFileSize     int64         `json:"maxFileSize"`     // Tamaño máximo de cualquier archivo en bytes; 0 solo aplica MaxUploadSize
+	RateLimit       int64         `json:"rateLimit"`       // Bytes por segundo que el servidor transfiere en total; 0 indica que no hay límite
+	ClientRateLimit int64         `json:"clientRateLimit"` // Bytes por segundo que transfiere cada cliente; 0 indica que no hay límite
+	CollisionPolicy string        `json:"collisionPolicy"` // Qué hacer si el archivo ya existe: overwrite, reject, rename o version
+	ImagePath       string        `json:"imagePath"`       // Ruta para archivos de imágenes
+	AudioPath       string        `json:"audioPath"`       // Ruta para archivos de audio
+	VideoPath       string        `json:"videoPath"`       // Ruta para archivos de video
+	TextPath        string        `json:"textPath"`        // Ruta para archivos de texto
+	StagingPath     string        `json:"stagingPath"`     // Ruta donde se reciben los archivos sin extensión válida al enrutar por contenido
+	UsageFile       string        `json:"usageFile"`       // Archivo donde se registra qué cliente subió cada archivo
+	RouteByContent  bool          `json:"routeByContent"`  // Guarda los archivos según el tipo detectado si la extensión falta o no coincide
+	ImageExtensions []string      `json:"imageExtensions"` // Extensiones de archivos de imágenes permitidas
+	AudioExtensions []string      `json:"audioExtensions"` // Extensiones de archivos de audio permitidas
+	VideoExtensions []string      `json:"videoExtensions"` // Extensiones de archivos de video permitidas
+	TextExtensions  []string      `json:"textExtensions"`  // Extensiones de archivos de texto permitidas
+	TLSCert         string        `json:"tlsCert"`         // Certificado del servidor TCP; si está vacío no se usa TLS
+	TLSKey          string        `json:"tlsKey"`          // Llave privada del certificado del servidor TCP
+	TLSClientCA     string        `json:"tlsClientCA"`     // CA para verificar certificados de clientes (TLS mutuo)
+	Tokens          []ClientToken `json:"tokens"`          // Tokens de acceso válidos; si está vacío no se exige autenticación
+	// Categorías de archivo por nombre. Se combinan con las categorías images, audios, videos y texts
+	// definidas por las llaves *Path y *Extensions; una categoría con el mismo nombre las reemplaza.
+	Categories map[string]Category `json:"categories"`
+}
+
+// MaxFileNameLen es la longitud máxima en bytes del nombre de un archivo, el límite de la mayoría de los
+// sistemas de archivos.
+const MaxFileNameLen = 255
+
+// Longitudes máximas en bytes de los campos del encabezado, que se verifican antes de reservar memoria
+// para leerlos:
+const (
+	MaxPathLen  = 4096 // Nombre del archivo tal como lo envía el cliente, antes de quitar los directorios
+	MaxTokenLen = 1024 // Credencial del cliente
+)
+
+// MaxUploadSize es el tamaño máximo de cualquier archivo aunque no se configure maxFileSize, para que el
+// tamaño que declara el cliente no pueda reservar recursos sin límite.
+const MaxUploadSize int64 = 1 << 40 // 1 TiB
+
+// reservedNames contiene los nombres de dispositivo que Windows reserva sin importar la extensión.
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
 }
 
 // GlobalConfig contiene la configuración global del servidor.
@@ -37,21 +172,29 @@ var GlobalConfig = ConnConfig{
 	TcpPort:         8080,        // Puerto TCP predeterminado
 	UdpPort:         8000,        // Puerto UDP predeterminado
 	ChunkSize:       1024,        // Tamaño predeterminado del fragmento
+	IdleTimeout:     60,          // Tiempo de inactividad predeterminado de una conexión TCP
+	TCPKeepAlive:    15,          // Intervalo predeterminado de los sondeos keep-alive
+	PartialExpiry:   24,          // Horas predeterminadas que se conserva un archivo parcial
+	CollisionPolicy: "overwrite", // Política de colisión predeterminada
 	ImagePath:       "Multimedia/Images",
 	AudioPath:       "Multimedia/Audios",
 	VideoPath:       "Multimedia/Videos",
 	TextPath:        "Multimedia/Texts",
+	StagingPath:     "Multimedia/.staging",
+	UsageFile:       "usage.json",
 	ImageExtensions: []string{".jpg", ".jpeg", ".png"},
 	AudioExtensions: []string{".mp3", ".wav", ".mid"},
 	VideoExtensions: []string{".mp4", ".avi", ".flv"},
 	TextExtensions:  []string{".txt"},
 }
 
-// FileMessage representa un mensaje multimedia.
+// FileMessage representa el encabezado de un mensaje multimedia.
 type FileMessage struct {
-	FileName string   // Nombre del archivo
-	Data     []byte   // Datos del archivo
-	Hash     [32]byte // Hash del archivo
+	Collision byte     // Política de colisión solicitada por el cliente
+	Flags     byte     // Opciones de la subida, por ejemplo UploadKeepPath
+	FileName  string   // Nombre del archivo
+	DataLen   int64    // Longitud de los datos del archivo
+	Hash      [32]byte // Hash del archivo
 }
 
 // contains verifica si un valor está presente en un slice de strings.
@@ -64,25 +207,227 @@ func contains(value string, array []string) string {
 	return ""
 }
 
-// GetFileType devuelve la extensión, la ruta y la validez del tipo de archivo.
-func GetFileType(fileName string) (string, string, bool) {
+// GetFileType devuelve la extensión, la categoría y la validez del tipo de archivo.
+func GetFileType(fileName string) (string, Category, bool) {
 	ext := filepath.Ext(fileName)
-	filePath := ""
-	valid := true
+	if ext == "" {
+		return ext, Category{}, false
+	}
+	// Cada extensión pertenece a una sola categoría, así que el orden del recorrido no importa:
+	for _, category := range GlobalConfig.Categories {
+		if contains(ext, category.Extensions) != "" {
+			return ext, category, true
+		}
+	}
+	return ext, Category{}, false
+}
+
+// UploadDir devuelve el directorio donde se reciben los datos de fileName: el de su tipo si la extensión
+// es válida o, si se enruta por contenido, el directorio de espera hasta conocer el tipo real. Devuelve un
+// *UploadError si el tipo no es válido o si size supera MaxUploadSize, el tamaño máximo global o el de la
+// categoría.
+func UploadDir(fileName string, size int64) (string, error) {
+	if size > MaxUploadSize {
+		return "", &UploadError{MsgTooLarge, fmt.Sprintf("el archivo supera el tamaño máximo permitido: %d bytes", MaxUploadSize)}
+	}
+	if GlobalConfig.MaxFileSize > 0 && size > GlobalConfig.MaxFileSize {
+		return "", &UploadError{MsgTooLarge, fmt.Sprintf("el archivo supera el tamaño máximo permitido: %d bytes", GlobalConfig.MaxFileSize)}
+	}
+	fileType, category, valid := GetFileType(fileName)
+	if !valid {
+		if GlobalConfig.RouteByContent {
+			return GlobalConfig.StagingPath, nil
+		}
+		return "", &UploadError{MsgInvalidType, "extensión de archivo no válida: " + fileType}
+	}
+	if category.MaxSize > 0 && size > category.MaxSize {
+		return "", &UploadError{MsgTooLarge, fmt.Sprintf("el archivo supera el tamaño máximo de la categoría %s: %d bytes", category.Name, category.MaxSize)}
+	}
+	return filepath.Join(category.Path, fileType), nil
+}
+
+// StoredFilePath devuelve la ruta de un archivo guardado a partir del nombre de su categoría y del
+// nombre del archivo. Devuelve un *UploadError con MsgNotFound si la categoría no existe o si la
+// extensión no pertenece a ella, y con MsgBadRequest si el nombre no es válido.
+func StoredFilePath(categoryName, fileName string) (string, error) {
+	category, ok := GlobalConfig.Categories[categoryName]
+	if !ok {
+		return "", &UploadError{MsgNotFound, "categoría no encontrada: " + categoryName}
+	}
+	name, err := SanitizeFilePath(fileName)
+	if err != nil || name != fileName {
+		return "", &UploadError{MsgBadRequest, "nombre de archivo no válido: " + fileName}
+	}
+	ext := filepath.Ext(name)
+	if contains(ext, category.Extensions) == "" {
+		return "", &UploadError{MsgNotFound, fmt.Sprintf("la categoría %s no contiene archivos %s", categoryName, ext)}
+	}
+	return filepath.Join(category.Path, ext, name), nil
+}
+
+// DeleteFile elimina el archivo fileName de la categoría indicada y devuelve su ruta. Devuelve un
+// *UploadError con MsgNotFound si el archivo no existe.
+func DeleteFile(categoryName, fileName string) (string, error) {
+	path, err := StoredFilePath(categoryName, fileName)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		return "", &UploadError{MsgNotFound, "archivo no encontrado: " + categoryName + "/" + fileName}
+	}
+	if err != nil {
+		return "", err
+	}
 
-	switch ext {
-	case contains(ext, GlobalConfig.ImageExtensions):
-		filePath = GlobalConfig.ImagePath
-	case contains(ext, GlobalConfig.AudioExtensions):
-		filePath = GlobalConfig.AudioPath
-	case contains(ext, GlobalConfig.VideoExtensions):
-		filePath = GlobalConfig.VideoPath
-	case contains(ext, GlobalConfig.TextExtensions):
-		filePath = GlobalConfig.TextPath
-	default:
-		valid = false
+	err = os.Remove(path)
+	if err != nil {
+		return "", err
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return "", err
 	}
-	return ext, filePath, valid
+	Usage.Remove(path, categoryName, info.Size())
+	return path, nil
+}
+
+// RenameFile cambia el nombre del archivo oldName de la categoría indicada a newName, que debe pertenecer
+// a la misma categoría, y devuelve las rutas anterior y nueva. Nunca reemplaza un archivo existente:
+// devuelve un *UploadError con MsgExists si newName ya existe, con MsgNotFound si oldName no existe y con
+// MsgContentMismatch si la nueva extensión no corresponde al contenido del archivo.
+func RenameFile(categoryName, oldName, newName string) (string, string, error) {
+	oldPath, err := StoredFilePath(categoryName, oldName)
+	if err != nil {
+		return "", "", err
+	}
+	newPath, err := StoredFilePath(categoryName, newName)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Lstat(oldPath)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		return "", "", &UploadError{MsgNotFound, "archivo no encontrado: " + categoryName + "/" + oldName}
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	// Si cambia la extensión, el contenido debe corresponder a la nueva:
+	if filepath.Ext(oldName) != filepath.Ext(newName) {
+		mime, err := SniffFile(oldPath)
+		if err != nil {
+			return "", "", err
+		}
+		expected := mimeForExt(strings.ToLower(filepath.Ext(newName)))
+		if mime != "" && expected != "" && mime != expected {
+			return "", "", &UploadError{MsgContentMismatch, fmt.Sprintf("el contenido del archivo (%s) no coincide con la extensión %s", mime, filepath.Ext(newName))}
+		}
+	}
+
+	newDir := filepath.Dir(newPath)
+	err = os.MkdirAll(newDir, os.ModePerm)
+	if err != nil {
+		return "", "", err
+	}
+	err = linkNewFile(oldPath, newPath)
+	if errors.Is(err, fs.ErrExist) {
+		return "", "", &UploadError{MsgExists, "el archivo ya existe: " + newName}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	err = syncDir(newDir)
+	if err == nil && newDir != filepath.Dir(oldPath) {
+		err = syncDir(filepath.Dir(oldPath))
+	}
+	Usage.Rename(oldPath, newPath)
+	return oldPath, newPath, err
+}
+
+// buildCategories combina las categorías definidas por las llaves *Path y *Extensions con las
+// categorías personalizadas. Devuelve un error si una categoría no tiene ruta o si una extensión
+// pertenece a más de una categoría.
+func buildCategories(custom map[string]Category) (map[string]Category, error) {
+	categories := map[string]Category{
+		"images": {Path: GlobalConfig.ImagePath, Extensions: GlobalConfig.ImageExtensions},
+		"audios": {Path: GlobalConfig.AudioPath, Extensions: GlobalConfig.AudioExtensions},
+		"videos": {Path: GlobalConfig.VideoPath, Extensions: GlobalConfig.VideoExtensions},
+		"texts":  {Path: GlobalConfig.TextPath, Extensions: GlobalConfig.TextExtensions},
+	}
+	for name, category := range custom {
+		categories[name] = category
+	}
+
+	owners := make(map[string]string)
+	for name, category := range categories {
+		if category.Path == "" {
+			return nil, fmt.Errorf("la categoría %s no tiene ruta", name)
+		}
+		for _, ext := range category.Extensions {
+			if owner, ok := owners[ext]; ok {
+				return nil, fmt.Errorf("la extensión %s pertenece a las categorías %s y %s", ext, owner, name)
+			}
+			owners[ext] = name
+		}
+		category.Name = name
+		categories[name] = category
+	}
+	return categories, nil
+}
+
+// SanitizeFileName convierte el nombre enviado por el cliente en un nombre seguro para guardarlo dentro
+// del directorio de su tipo. Descarta los componentes de directorio (tanto "/" como "\"), normaliza el
+// nombre a Unicode NFC y quita los espacios y puntos finales. Devuelve un error si el nombre queda
+// vacío, es oculto, contiene caracteres de control, es un nombre reservado o supera MaxFileNameLen.
+func SanitizeFileName(fileName string) (string, error) {
+	if !utf8.ValidString(fileName) {
+		return "", fmt.Errorf("el nombre del archivo no es UTF-8 válido")
+	}
+	for _, r := range fileName {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("el nombre del archivo contiene caracteres de control: %q", fileName)
+		}
+	}
+
+	// Se conserva solo el último componente de la ruta, sin importar el separador que use el cliente:
+	name := fileName[strings.LastIndexAny(fileName, `/\`)+1:]
+	name = norm.NFC.String(name)
+	name = strings.TrimRight(name, " .")
+
+	switch {
+	case name == "":
+		return "", fmt.Errorf("nombre de archivo vacío: %q", fileName)
+	case strings.HasPrefix(name, "."):
+		// Los nombres ocultos se reservan para los archivos parciales y temporales del servidor:
+		return "", fmt.Errorf("nombre de archivo oculto no permitido: %q", name)
+	case len(name) > MaxFileNameLen:
+		return "", fmt.Errorf("el nombre del archivo supera %d bytes", MaxFileNameLen)
+	}
+
+	base := strings.ToUpper(strings.TrimSpace(strings.SplitN(name, ".", 2)[0]))
+	if contains(base, reservedNames) != "" {
+		return "", fmt.Errorf("nombre de archivo reservado: %q", name)
+	}
+	return name, nil
+}
+
+// SanitizeFilePath es como SanitizeFileName, pero conserva los subdirectorios de la ruta enviada por el
+// cliente: limpia cada componente por separado y los une con "/". Los componentes vacíos se descartan,
+// de modo que la ruta siempre queda dentro del directorio de su tipo.
+func SanitizeFilePath(filePath string) (string, error) {
+	var parts []string
+	for _, part := range strings.FieldsFunc(filePath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		name, err := SanitizeFileName(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, name)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("nombre de archivo vacío: %q", filePath)
+	}
+	return strings.Join(parts, "/"), nil
 }
 
 // SetIfNotEmpty asigna el valor src a dest si src no está vacío.
@@ -106,6 +451,20 @@ func SetIfNotEmptyInt(dest *int, src int) {
 	}
 }
 
+// SetIfNotEmptyInt64 asigna el valor src a dest si src no es 0.
+func SetIfNotEmptyInt64(dest *int64, src int64) {
+	if src != 0 {
+		*dest = src
+	}
+}
+
+// SetIfTrue asigna true a dest si src es true.
+func SetIfTrue(dest *bool, src bool) {
+	if src {
+		*dest = true
+	}
+}
+
 // GetLocalIP devuelve la dirección IP local de la máquina.
 func GetLocalIP() (string, error) {
 	addrs, err := net.InterfaceAddrs()
@@ -130,7 +489,8 @@ func ReadConfigFile(filename string) error {
 	if err != nil {
 		// Si hay un error al abrir el archivo se utilizan valores predeterminados:
 		file.Close()
-		return nil
+		GlobalConfig.Categories, err = buildCategories(nil)
+		return err
 	}
 	defer file.Close()
 
@@ -153,23 +513,178 @@ func ReadConfigFile(filename string) error {
 	}
 	SetIfNotEmptyInt(&GlobalConfig.TcpPort, config.TcpPort)
 	SetIfNotEmptyInt(&GlobalConfig.UdpPort, config.UdpPort)
+	SetIfTrue(&GlobalConfig.UdpEncryption, config.UdpEncryption)
+	SetIfNotEmpty(&GlobalConfig.UdpPSK, config.UdpPSK)
 	SetIfNotEmptyInt(&GlobalConfig.ChunkSize, config.ChunkSize)
+	SetIfNotEmptyInt(&GlobalConfig.IdleTimeout, config.IdleTimeout)
+	SetIfNotEmptyInt(&GlobalConfig.TCPKeepAlive, config.TCPKeepAlive)
+	SetIfNotEmptyInt(&GlobalConfig.PartialExpiry, config.PartialExpiry)
+	if GlobalConfig.IdleTimeout < 0 {
+		return fmt.Errorf("tiempo de inactividad no válido: %d", GlobalConfig.IdleTimeout)
+	}
+	SetIfNotEmptyInt64(&GlobalConfig.MaxFileSize, config.MaxFileSize)
+	SetIfNotEmptyInt64(&GlobalConfig.RateLimit, config.RateLimit)
+	SetIfNotEmptyInt64(&GlobalConfig.ClientRateLimit, config.ClientRateLimit)
+	SetIfNotEmpty(&GlobalConfig.CollisionPolicy, config.CollisionPolicy)
+	if _, ok := collisionPolicies[GlobalConfig.CollisionPolicy]; !ok {
+		return fmt.Errorf("política de colisión no válida: %s", GlobalConfig.CollisionPolicy)
+	}
 	SetIfNotEmpty(&GlobalConfig.ImagePath, config.ImagePath)
 	SetIfNotEmpty(&GlobalConfig.AudioPath, config.AudioPath)
 	SetIfNotEmpty(&GlobalConfig.VideoPath, config.VideoPath)
 	SetIfNotEmpty(&GlobalConfig.TextPath, config.TextPath)
+	SetIfNotEmpty(&GlobalConfig.StagingPath, config.StagingPath)
+	SetIfNotEmpty(&GlobalConfig.UsageFile, config.UsageFile)
+	SetIfTrue(&GlobalConfig.RouteByContent, config.RouteByContent)
 	SetIfNotEmptyExtensions(&GlobalConfig.ImageExtensions, config.ImageExtensions)
 	SetIfNotEmptyExtensions(&GlobalConfig.AudioExtensions, config.AudioExtensions)
 	SetIfNotEmptyExtensions(&GlobalConfig.VideoExtensions, config.VideoExtensions)
 	SetIfNotEmptyExtensions(&GlobalConfig.TextExtensions, config.TextExtensions)
+	SetIfNotEmpty(&GlobalConfig.TLSCert, config.TLSCert)
+	SetIfNotEmpty(&GlobalConfig.TLSKey, config.TLSKey)
+	SetIfNotEmpty(&GlobalConfig.TLSClientCA, config.TLSClientCA)
+	if config.Tokens != nil {
+		GlobalConfig.Tokens = config.Tokens
+	}
+	GlobalConfig.Categories, err = buildCategories(config.Categories)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// Authenticate verifica el token enviado por el cliente contra los tokens configurados y devuelve el
+// nombre del cliente. Si no hay tokens configurados, la autenticación está deshabilitada.
+func Authenticate(token string) (string, bool) {
+	if len(GlobalConfig.Tokens) == 0 {
+		return "", true
+	}
+	for _, t := range GlobalConfig.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t.Name, true
+		}
+	}
+	return "", false
+}
+
+// LoadTLSConfig crea la configuración TLS del listener TCP a partir del certificado y la llave del
+// servidor. Si se configuró una CA de clientes, se exige y verifica el certificado de cada cliente.
+// Devuelve nil si no se configuró un certificado.
+func LoadTLSConfig() (*tls.Config, error) {
+	if GlobalConfig.TLSCert == "" && GlobalConfig.TLSKey == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(GlobalConfig.TLSCert, GlobalConfig.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("al cargar el certificado del servidor: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if GlobalConfig.TLSClientCA != "" {
+		caPEM, err := os.ReadFile(GlobalConfig.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("al leer la CA de clientes: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("la CA de clientes no contiene certificados válidos")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
 // WriteLog escribe un mensaje en la terminal con una marca de tiempo.
 func WriteLog(filePath string) {
+	LogEvent("Archivo subido exitosamente:", filePath)
+}
+
+// LogEvent escribe en la terminal un evento con una marca de tiempo, seguido del archivo o la conexión a
+// la que se refiere.
+func LogEvent(event string, subject string) {
 	fmt.Print("[" + time.Now().Format("2006-01-02 15:04:05") + "] ")
-	fmt.Println("Archivo subido exitosamente:", filePath)
+	fmt.Println(event, subject)
+}
+
+// Failure registra un error en la terminal de logs y devuelve una respuesta con el código de estado
+// y la razón indicados.
+func Failure(status byte, reason string) Response {
+	fmt.Println("[ERROR]", reason)
+	return Response{Status: status, Reason: reason}
+}
+
+// UploadError indica que el servidor rechaza una operación sobre un archivo, por ejemplo por su tipo, su
+// contenido o su tamaño.
+type UploadError struct {
+	Status byte   // Código de estado que se envía al cliente
+	Reason string // Descripción del error
+}
+
+func (e *UploadError) Error() string {
+	return e.Reason
+}
+
+// UploadFailure convierte el error devuelto al validar un archivo en la respuesta que se envía al
+// cliente: la de un *UploadError o, para cualquier otro error, una de almacenamiento.
+func UploadFailure(err error) Response {
+	return OperationFailure("al guardar el archivo", err)
+}
+
+// OperationFailure convierte el error de una operación sobre archivos en la respuesta que se envía al
+// cliente: la de un *UploadError o, para cualquier otro error, una de almacenamiento que ocurrió
+// durante action.
+func OperationFailure(action string, err error) Response {
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) {
+		return Failure(uploadErr.Status, uploadErr.Reason)
+	}
+	return StorageFailure(action, err)
+}
+
+// StorageFailure registra un error de almacenamiento y devuelve una respuesta MsgStorageError. Al cliente
+// solo se le envía la causa del sistema operativo (por ejemplo, disco lleno), sin las rutas del servidor.
+func StorageFailure(action string, err error) Response {
+	fmt.Println("[ERROR]", action+":", err)
+	cause := err
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) {
+		cause = pathErr.Err
+	} else if errors.As(err, &linkErr) {
+		cause = linkErr.Err
+	}
+	return Response{Status: MsgStorageError, Reason: action + ": " + cause.Error()}
+}
+
+// Encode codifica la respuesta: estado (1), longitud de la razón (2), razón, longitud de la ruta (2),
+// ruta, hash (32), longitud de los datos adicionales (4) y datos adicionales.
+func (r Response) Encode() []byte {
+	reason := truncate(r.Reason, math.MaxUint16)
+	path := truncate(r.Path, math.MaxUint16)
+	buf := make([]byte, 0, 1+2+len(reason)+2+len(path)+32+4+len(r.Body))
+	buf = append(buf, r.Status)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(reason)))
+	buf = append(buf, reason...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(path)))
+	buf = append(buf, path...)
+	buf = append(buf, r.Hash[:]...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(r.Body)))
+	return append(buf, r.Body...)
+}
+
+// truncate recorta s a un máximo de n bytes.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
 }
 
 // CompareHash256 compara dos hashes SHA-256 (32 bytes).
@@ -180,20 +695,263 @@ func CompareHash256(hash1, hash2 [32]byte) error {
 	return nil
 }
 
-// CreateFile crea un archivo a partir del mensaje enviado por el cliente.
-func CreateFile(outPath string, fileMsg *FileMessage) error {
-	out, err := os.Create(outPath)
+// NewTempFile crea un archivo temporal oculto dentro de dir con los mismos permisos que tendría un
+// archivo creado con os.Create, ya que será renombrado a su ruta final.
+func NewTempFile(dir string) (*os.File, error) {
+	out, err := os.CreateTemp(dir, ".upload-*.tmp")
 	if err != nil {
-		out.Close() // Cierra la conexión del archivo
-		return fmt.Errorf("al crear archivo en el servidor")
+		return nil, fmt.Errorf("al crear archivo temporal en el servidor: %w", err)
 	}
+	err = out.Chmod(0644)
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, fmt.Errorf("al crear archivo temporal en el servidor: %w", err)
+	}
+	return out, nil
+}
 
-	// Escribe los datos del archivo en el archivo:
-	_, err = out.Write(fileMsg.Data)
+// PartialFilePath devuelve la ruta del archivo parcial de una subida dentro de dir. El nombre se
+// deriva del hash del archivo para que una subida interrumpida pueda reanudarse.
+func PartialFilePath(dir string, hash [32]byte) string {
+	return filepath.Join(dir, "."+hex.EncodeToString(hash[:])+".part")
+}
+
+// OpenPartialFile abre o crea el archivo parcial de una subida de size bytes. Devuelve el archivo
+// posicionado al final de los datos ya recibidos, la cantidad de esos bytes y un hash SHA-256 que
+// ya los incluye. Si el archivo parcial es más grande que size no corresponde a la subida y se vacía.
+func OpenPartialFile(partPath string, size int64) (*os.File, int64, hash.Hash, error) {
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		out.Close() // Cierra la conexión del archivo
-		return fmt.Errorf("al escribir datos del archivo")
+		return nil, 0, nil, fmt.Errorf("al crear archivo parcial en el servidor: %w", err)
 	}
-	defer out.Close()
-	return nil
+
+	info, err := part.Stat()
+	if err != nil {
+		part.Close()
+		return nil, 0, nil, fmt.Errorf("al obtener información del archivo parcial: %w", err)
+	}
+	offset := info.Size()
+	if offset > size {
+		err = part.Truncate(0)
+		if err != nil {
+			part.Close()
+			return nil, 0, nil, fmt.Errorf("al vaciar el archivo parcial: %w", err)
+		}
+		offset = 0
+	}
+
+	// Se leen los bytes ya recibidos para incluirlos en el hash; al terminar, el archivo queda
+	// posicionado al final de los datos:
+	hasher := sha256.New()
+	_, err = io.CopyN(hasher, part, offset)
+	if err != nil {
+		part.Close()
+		return nil, 0, nil, fmt.Errorf("al leer el archivo parcial: %w", err)
+	}
+	return part, offset, hasher, nil
+}
+
+// SaveUpload verifica el contenido del archivo de size bytes recibido en tmpPath y lo guarda con
+// StoreFile en el directorio de su categoría. Registra el archivo en el uso de almacenamiento del
+// cliente y devuelve la ruta con la que se guardó. Devuelve un *UploadError si el archivo se rechaza
+// por su contenido, por la cuota de la categoría a la que lo enruta su contenido o por la política de
+// colisión.
+func SaveUpload(tmpPath, fileName string, size int64, policy byte, client string) (string, error) {
+	storedName, dir, err := CheckContent(tmpPath, fileName, size)
+	if err != nil {
+		return "", err
+	}
+
+	// Si el contenido enrutó el archivo a otra categoría, la reserva de la subida no cubre esa categoría
+	// y se verifica su cuota antes de guardarlo:
+	_, declared, _ := GetFileType(fileName)
+	_, category, _ := GetFileType(storedName)
+	if category.Name != declared.Name {
+		reservation, err := Usage.ReserveCategory(category.Name, size, ReplacedPath(dir, storedName, policy))
+		if err != nil {
+			return "", err
+		}
+		defer Usage.Release(reservation)
+	}
+
+	outPath, replaced, err := StoreFile(tmpPath, dir, storedName, policy)
+	if err != nil {
+		return "", err
+	}
+	Usage.Record(outPath, category.Name, client, size, replaced)
+	return outPath, nil
+}
+
+// StoreFile mueve el archivo recibido en tmpPath a su ruta final dentro de dir aplicando la política de
+// colisión indicada, o la configurada en el servidor si es CollisionDefault. Devuelve la ruta con la que
+// se guardó el archivo y el tamaño del archivo que reemplazó, o un *UploadError con MsgExists si el
+// archivo ya existe y la política lo rechaza. El contenido de tmpPath ya debe estar sincronizado con
+// SyncFile; el cambio de nombre se sincroniza aquí, de modo que el archivo final nunca queda truncado
+// aunque el servidor se detenga. Si no se puede sincronizar, el archivo final se elimina.
+func StoreFile(tmpPath, dir, fileName string, policy byte) (string, int64, error) {
+	// El nombre puede incluir subdirectorios si la subida los conserva:
+	outDir := filepath.Dir(filepath.Join(dir, fileName))
+	err := os.MkdirAll(outDir, os.ModePerm)
+	if err != nil {
+		return "", 0, err
+	}
+	outPath, replaced, err := moveFile(tmpPath, dir, fileName, resolveCollision(policy))
+	if err != nil {
+		return "", 0, err
+	}
+	err = syncDir(outDir)
+	if err != nil {
+		// El cliente recibe un error y el archivo no se registra en el uso, así que no se conserva:
+		os.Remove(outPath)
+		return "", 0, err
+	}
+	return outPath, replaced, nil
+}
+
+// moveFile mueve tmpPath a dir/fileName según la política de colisión. Devuelve la ruta final y el
+// tamaño del archivo que se reemplazó, o 0 si no se reemplazó ninguno.
+func moveFile(tmpPath, dir, fileName string, policy byte) (string, int64, error) {
+	outPath := filepath.Join(dir, fileName)
+
+	switch policy {
+	case CollisionReject:
+		err := linkNewFile(tmpPath, outPath)
+		if errors.Is(err, fs.ErrExist) {
+			return "", 0, &UploadError{MsgExists, "el archivo ya existe: " + fileName}
+		}
+		return outPath, 0, err
+	case CollisionRename:
+		// Se busca el primer nombre libre; el enlace falla si otro archivo ocupa el nombre entretanto:
+		for n := 0; ; n++ {
+			candidate := outPath
+			if n > 0 {
+				candidate = numberedPath(outPath, fmt.Sprintf("_%d", n))
+			}
+			err := linkNewFile(tmpPath, candidate)
+			if !errors.Is(err, fs.ErrExist) {
+				return candidate, 0, err
+			}
+		}
+	case CollisionVersion:
+		// Se conserva el archivo existente con el primer número de versión libre:
+		for n := 1; ; n++ {
+			versionPath := numberedPath(outPath, fmt.Sprintf(".v%d", n))
+			err := linkFile(outPath, versionPath)
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			if err == nil {
+				Usage.Rename(outPath, versionPath)
+				break
+			}
+			if !errors.Is(err, fs.ErrExist) {
+				return "", 0, err
+			}
+		}
+		return outPath, 0, renameFile(tmpPath, outPath)
+	}
+
+	// Se sobrescribe el archivo existente, si lo hay:
+	var replaced int64
+	info, err := os.Stat(outPath)
+	if err == nil {
+		replaced = info.Size()
+	}
+	return outPath, replaced, renameFile(tmpPath, outPath)
+}
+
+// RejectsExisting indica si la subida será rechazada porque el archivo ya existe en dir y la política
+// de colisión es CollisionReject. Permite rechazar la subida antes de recibir los datos; StoreFile
+// vuelve a comprobarlo al guardar el archivo.
+func RejectsExisting(dir, fileName string, policy byte) bool {
+	if resolveCollision(policy) != CollisionReject {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(dir, fileName))
+	return err == nil
+}
+
+// Operaciones del sistema de archivos con las que se guardan las subidas; las pruebas las reemplazan para
+// simular fallas de escritura.
+var (
+	syncFile   = (*os.File).Sync
+	renameFile = os.Rename
+	linkFile   = os.Link
+)
+
+// SyncFile escribe en disco el contenido de file y lo cierra. Si falla, el contenido del archivo no es
+// confiable y el archivo se cierra de todos modos.
+func SyncFile(file *os.File) error {
+	err := syncFile(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir escribe en disco las entradas del directorio dir para que los cambios de nombre sobrevivan a
+// una caída del sistema. Windows no permite sincronizar directorios y ahí no tiene efecto.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// ReplacedPath devuelve la ruta del archivo que reemplazará la subida de fileName en dir si la política de
+// colisión lo sobrescribe, o una cadena vacía si la política conserva el archivo existente.
+func ReplacedPath(dir, fileName string, policy byte) string {
+	if resolveCollision(policy) != CollisionOverwrite {
+		return ""
+	}
+	return filepath.Join(dir, fileName)
+}
+
+// resolveCollision devuelve la política configurada en el servidor si policy es CollisionDefault.
+func resolveCollision(policy byte) byte {
+	if policy == CollisionDefault {
+		return collisionPolicies[GlobalConfig.CollisionPolicy]
+	}
+	return policy
+}
+
+// linkNewFile mueve src a dst solo si dst no existe; a diferencia de os.Rename, nunca reemplaza un
+// archivo existente.
+func linkNewFile(src, dst string) error {
+	err := linkFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// numberedPath inserta suffix entre el nombre y la extensión de path.
+func numberedPath(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + suffix + ext
+}
+
+// HashFile calcula el hash SHA-256 del archivo en la ruta indicada.
+func HashFile(path string) ([32]byte, error) {
+	var hash [32]byte
+	file, err := os.Open(path)
+	if err != nil {
+		return hash, fmt.Errorf("al abrir el archivo: %w", err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return hash, fmt.Errorf("al leer los datos del archivo: %w", err)
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return hash, nil
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errInjected es el error de las fallas de escritura simuladas.
+var errInjected = errors.New("falla de escritura simulada")
+
+// writeFailure es una falla de escritura que se simula al guardar una subida con la política policy.
+type writeFailure struct {
+	name   string
+	policy byte
+	inject func(t *testing.T)
+}
+
+// storeFailures son las fallas que pueden ocurrir al mover un archivo recibido a su ruta final.
+var storeFailures = []writeFailure{
+	{"renombrar", CollisionOverwrite, injectRenameFailure},
+	{"enlazar sin reemplazar", CollisionReject, injectLinkFailure},
+	{"enlazar con otro nombre", CollisionRename, injectLinkFailure},
+	{"sincronizar el directorio", CollisionOverwrite, func(t *testing.T) { injectSyncFailure(t, true) }},
+}
+
+// injectSyncFailure hace que falle la sincronización de los directorios si dirs es verdadero o la de los
+// archivos si no, mientras dura la prueba.
+func injectSyncFailure(t *testing.T, dirs bool) {
+	saved := syncFile
+	t.Cleanup(func() { syncFile = saved })
+	syncFile = func(f *os.File) error {
+		info, err := f.Stat()
+		if err == nil && info.IsDir() == dirs {
+			return errInjected
+		}
+		return saved(f)
+	}
+}
+
+// injectRenameFailure hace que fallen los cambios de nombre mientras dura la prueba.
+func injectRenameFailure(t *testing.T) {
+	saved := renameFile
+	t.Cleanup(func() { renameFile = saved })
+	renameFile = func(string, string) error { return errInjected }
+}
+
+// injectLinkFailure hace que fallen los enlaces mientras dura la prueba.
+func injectLinkFailure(t *testing.T) {
+	saved := linkFile
+	t.Cleanup(func() { linkFile = saved })
+	linkFile = func(string, string) error { return errInjected }
+}
+
+// setupStorage configura una categoría de texto dentro de un directorio temporal y devuelve el
+// directorio donde se guardan sus archivos .txt.
+func setupStorage(t *testing.T) string {
+	saved := GlobalConfig
+	t.Cleanup(func() { GlobalConfig = saved })
+	root := t.TempDir()
+	GlobalConfig.Categories = map[string]Category{
+		"texts": {Name: "texts", Path: filepath.Join(root, "texts"), Extensions: []string{".txt"}},
+	}
+	GlobalConfig.UsageFile = filepath.Join(root, "usage.json")
+	t.Cleanup(Usage.Flush) // Se escribe el registro antes de restaurar la configuración
+	GlobalConfig.CollisionPolicy = "overwrite"
+	GlobalConfig.RouteByContent = false
+
+	dir := filepath.Join(root, "texts", ".txt")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// receivedFile crea en dir un archivo temporal sincronizado con data, como el de una subida recibida, y
+// devuelve su ruta.
+func receivedFile(t *testing.T, dir string, data []byte) string {
+	file, err := NewTempFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = SyncFile(file)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// assertNotExist falla la prueba si existe el archivo en path.
+func assertNotExist(t *testing.T, path, what string) {
+	t.Helper()
+	_, err := os.Lstat(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s existe después de la falla: %s", what, path)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	long := strings.Repeat("a", MaxFileNameLen-4) + ".txt"
+	tests := []struct {
+		name  string
+		input string
+		want  string // Nombre esperado; vacío si se espera un error
+	}{
+		{"simple", "foto.jpg", "foto.jpg"},
+		{"espacios internos", "mi foto.jpg", "mi foto.jpg"},
+		{"subir de directorio", "../../etc/passwd", "passwd"},
+		{"subir de directorio con barra invertida", `..\..\Windows\win.ini`, "win.ini"},
+		{"ruta absoluta", "/etc/passwd", "passwd"},
+		{"ruta absoluta de Windows", `C:\Users\a\foto.jpg`, "foto.jpg"},
+		{"separadores mezclados", `a/b\c.txt`, "c.txt"},
+		{"solo directorio", "../", ""},
+		{"punto punto", "..", ""},
+		{"vacío", "", ""},
+		{"carácter nulo", "a\x00.txt", ""},
+		{"salto de línea", "a\n.txt", ""},
+		{"carácter de control C1", "a\u0085.txt", ""},
+		{"UTF-8 no válido", "a\xff.txt", ""},
+		{"NFC se conserva", "caf\u00e9.txt", "caf\u00e9.txt"},
+		{"NFD se normaliza a NFC", "cafe\u0301.txt", "caf\u00e9.txt"},
+		{"reservado", "CON", ""},
+		{"reservado con extensión", "CON.txt", ""},
+		{"reservado en minúsculas con espacio", "lpt1 .jpg", ""},
+		{"reservado con varias extensiones", "nul.tar.gz", ""},
+		{"no reservado con prefijo", "CONSOLE.txt", "CONSOLE.txt"},
+		{"puntos finales", "a.txt...", "a.txt"},
+		{"espacios finales", "a.txt   ", "a.txt"},
+		{"puntos y espacios finales", "a.txt . .", "a.txt"},
+		{"oculto", ".bashrc", ""},
+		{"oculto parcial", ".0123.part", ""},
+		{"oculto tras un directorio", "dir/.hidden", ""},
+		{"longitud máxima", long, long},
+		{"supera la longitud máxima", "a" + long, ""},
+		{"supera la longitud máxima en bytes", strings.Repeat("é", 128) + ".txt", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeFileName(tt.input)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("SanitizeFileName(%q) = %q, se esperaba un error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SanitizeFileName(%q) devolvió un error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeFileName(%q) = %q, se esperaba %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string // Ruta esperada; vacía si se espera un error
+	}{
+		{"nombre simple", "foto.jpg", "foto.jpg"},
+		{"subdirectorios", "viaje/dia1/foto.jpg", "viaje/dia1/foto.jpg"},
+		{"barra invertida", `viaje\dia1\foto.jpg`, "viaje/dia1/foto.jpg"},
+		{"ruta absoluta", "/viaje/foto.jpg", "viaje/foto.jpg"},
+		{"componentes vacíos", "viaje//foto.jpg/", "viaje/foto.jpg"},
+		{"subir de directorio", "../foto.jpg", ""},
+		{"subir de directorio en medio", "viaje/../../foto.jpg", ""},
+		{"subir de directorio con barra invertida", `viaje\..\..\foto.jpg`, ""},
+		{"directorio actual", "viaje/./foto.jpg", ""},
+		{"directorio oculto", ".git/config.txt", ""},
+		{"directorio reservado", "aux/foto.jpg", ""},
+		{"carácter de control", "viaje\t/foto.jpg", ""},
+		{"NFD se normaliza a NFC", "cafe\u0301/men\u0303u.txt", "caf\u00e9/me\u00f1u.txt"},
+		{"puntos finales en un directorio", "viaje../foto.jpg", "viaje/foto.jpg"},
+		{"componente demasiado largo", strings.Repeat("a", MaxFileNameLen+1) + "/foto.jpg", ""},
+		{"vacía", "", ""},
+		{"solo separadores", `/\/`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeFilePath(tt.input)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("SanitizeFilePath(%q) = %q, se esperaba un error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SanitizeFilePath(%q) devolvió un error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeFilePath(%q) = %q, se esperaba %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncFileFailure(t *testing.T) {
+	dir := setupStorage(t)
+	file, err := NewTempFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injectSyncFailure(t, false)
+
+	err = SyncFile(file)
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("SyncFile devolvió %v, se esperaba %v", err, errInjected)
+	}
+	// El archivo se cierra aunque falle la sincronización:
+	if err := file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("el archivo sigue abierto después de la falla: %v", err)
+	}
+}
+
+func TestStoreFileWriteFailures(t *testing.T) {
+	for _, tt := range storeFailures {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupStorage(t)
+			tmpPath := receivedFile(t, dir, []byte("hola\n"))
+			tt.inject(t)
+
+			_, _, err := StoreFile(tmpPath, dir, "a.txt", tt.policy)
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("StoreFile devolvió %v, se esperaba %v", err, errInjected)
+			}
+			assertNotExist(t, filepath.Join(dir, "a.txt"), "el archivo final")
+		})
+	}
+}
+
+func TestSaveUploadWriteFailures(t *testing.T) {
+	for _, tt := range storeFailures {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupStorage(t)
+			data := []byte("hola\n")
+			tmpPath := receivedFile(t, dir, data)
+			tt.inject(t)
+
+			_, err := SaveUpload(tmpPath, "a.txt", int64(len(data)), tt.policy, "")
+			if err == nil {
+				t.Fatal("SaveUpload no devolvió un error")
+			}
+			if response := UploadFailure(err); response.Status != MsgStorageError {
+				t.Errorf("el estado de la respuesta es %d, se esperaba %d", response.Status, MsgStorageError)
+			}
+			assertNotExist(t, filepath.Join(dir, "a.txt"), "el archivo final")
+		})
+	}
+}
+
+// pkiDir contiene la CA y los certificados de prueba; se generan con testdata/pki/gen.go.
+const pkiDir = "../testdata/pki"
+
+// acceptTLS acepta en 127.0.0.1 una conexión TLS con serverConfig de un cliente con clientConfig y lee
+// un mensaje del cliente. Devuelve el error del lado del servidor.
+func acceptTLS(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err == nil {
+			conn.Write([]byte("hola"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	message := make([]byte, 4)
+	_, err = io.ReadFull(conn, message)
+	if err == nil && string(message) != "hola" {
+		err = fmt.Errorf("mensaje inesperado: %q", message)
+	}
+	return err
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	caPEM, err := os.ReadFile(filepath.Join(pkiDir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(pkiDir, "client.pem"), filepath.Join(pkiDir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		clientCA     string            // CA de clientes del servidor; vacía si no se exige TLS mutuo
+		certificates []tls.Certificate // Certificados que presenta el cliente
+		wantErr      bool
+	}{
+		{"TLS", "", nil, false},
+		{"TLS mutuo", filepath.Join(pkiDir, "ca.pem"), []tls.Certificate{clientCert}, false},
+		{"TLS mutuo sin certificado de cliente", filepath.Join(pkiDir, "ca.pem"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := GlobalConfig
+			t.Cleanup(func() { GlobalConfig = saved })
+			GlobalConfig.TLSCert = filepath.Join(pkiDir, "server.pem")
+			GlobalConfig.TLSKey = filepath.Join(pkiDir, "server-key.pem")
+			GlobalConfig.TLSClientCA = tt.clientCA
+
+			serverConfig, err := LoadTLSConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig := &tls.Config{RootCAs: roots, Certificates: tt.certificates}
+			err = acceptTLS(t, serverConfig, clientConfig)
+			if tt.wantErr && err == nil {
+				t.Fatal("el servidor aceptó la conexión, se esperaba un rechazo")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("la conexión falló: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadTLSConfigDisabled(t *testing.T) {
+	saved := GlobalConfig
+	t.Cleanup(func() { GlobalConfig = saved })
+	GlobalConfig.TLSCert = ""
+	GlobalConfig.TLSKey = ""
+
+	config, err := LoadTLSConfig()
+	if config != nil || err != nil {
+		t.Fatalf("LoadTLSConfig() = %v, %v; se esperaba nil sin certificado", config, err)
+	}
+}
@@ -0,0 +1,101 @@
+//go:build ignore
+
+// gen genera la CA y los certificados de prueba que usan las pruebas de TLS del servidor y del cliente.
+// Se ejecuta desde este directorio con:
+//
+//	go run gen.go
+//
+// y escribe ca.pem, server.pem, server-key.pem, client.pem y client-key.pem. El certificado del
+// servidor es válido para localhost y 127.0.0.1, y el del cliente sirve para TLS mutuo. Todos caducan
+// en 2126, por lo que no hace falta regenerarlos.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+func main() {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2126, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CA de prueba"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER := writeCert("ca.pem", "", caTemplate, caTemplate, caKey, caKey)
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	writeCert("server.pem", "server-key.pem", serverTemplate, ca, newKey(), caKey)
+
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "cliente"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	writeCert("client.pem", "client-key.pem", clientTemplate, ca, newKey(), caKey)
+}
+
+// newKey genera una llave ECDSA P-256.
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// writeCert firma template con la llave de parent y lo escribe en certPath; si keyPath no está vacío,
+// también escribe ahí la llave privada. Devuelve el certificado en DER.
+func writeCert(certPath, keyPath string, template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) []byte {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keyPath != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return der
+}